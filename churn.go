@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parameters of a churn scenario, in which nodes join and are killed
+// over simulated time while the network holds a set of stored pairs
+type ChurnConfig struct {
+	Nodes    int           // the number of nodes in the network at the start
+	Keys     int           // the number of pairs put at the start, each by a random node
+	Duration time.Duration // the simulated time the scenario runs for
+	JoinRate float64       // the number of nodes joining per simulated hour
+	KillRate float64       // the number of nodes killed without warning per simulated hour
+	Probe    time.Duration // the simulated time between measurements of retrievable pairs
+	K        int           // the bucket size used by every node
+	Alpha    int           // the lookup parallelism used by every node
+	Seed     int64         // the seed deciding who joins through whom, who is killed, and who probes
+}
+
+// Measurement taken at a point in simulated time during a churn scenario
+type ChurnSample struct {
+	Time        time.Duration // the simulated time since the scenario started
+	Nodes       int           // the number of nodes alive
+	Retrievable int           // the number of pairs a random node could retrieve
+}
+
+// Results of a churn scenario
+type ChurnReport struct {
+	Config  ChurnConfig
+	Samples []ChurnSample
+	Joined  int
+	Killed  int
+	Elapsed time.Duration
+}
+
+// Fraction of the stored pairs which were retrievable at the end of
+// the scenario
+func (r *ChurnReport) Durability() float64 {
+	if len(r.Samples) == 0 || r.Config.Keys == 0 {
+		return 0
+	}
+
+	return float64(r.Samples[len(r.Samples)-1].Retrievable) / float64(r.Config.Keys)
+}
+
+func (r *ChurnReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "nodes=%d keys=%d k=%d alpha=%d join=%.1f/h kill=%.1f/h over %s (%s)\n",
+		r.Config.Nodes, r.Config.Keys, r.Config.K, r.Config.Alpha, r.Config.JoinRate, r.Config.KillRate,
+		r.Config.Duration, r.Elapsed.Round(time.Millisecond))
+	for _, sample := range r.Samples {
+		fmt.Fprintf(&b, "  t=%-8s nodes=%4d retrievable=%4d/%d\n",
+			sample.Time, sample.Nodes, sample.Retrievable, r.Config.Keys)
+	}
+	fmt.Fprintf(&b, "  joined=%d killed=%d durability=%.2f%%\n", r.Joined, r.Killed, 100*r.Durability())
+
+	return b.String()
+}
+
+// State of a running churn scenario
+type churnScenario struct {
+	config  ChurnConfig
+	random  *rand.Rand
+	network *SimNetwork
+	clock   *virtualClock
+	alive   []*Dht
+	elapsed time.Duration
+	report  *ChurnReport
+}
+
+// Run a churn scenario. The network is built and the pairs are put,
+// after which simulated time advances in steps of tMaintenance. At each
+// step nodes join and are killed at the configured rates, and every
+// node runs the work of its background loops, refreshing buckets,
+// replicating and republishing pairs, and purging expired pairs, so
+// that tReplicate, tRepublish and tExpire play out as they would in a
+// real network. Every probe interval, a random node looks up each pair
+// to measure how many remain retrievable. Killed nodes take the pairs
+// they published with them, so those pairs are no longer republished.
+func RunChurn(config ChurnConfig) (*ChurnReport, error) {
+	if config.Nodes < 2 {
+		return nil, fmt.Errorf("churn scenario needs at least 2 nodes, got %d", config.Nodes)
+	}
+	if config.Probe <= 0 {
+		config.Probe = time.Hour
+	}
+
+	start := time.Now()
+	s := newChurnScenario(config, start)
+	defer s.stopAll()
+
+	for i := 0; i < config.Nodes; i++ {
+		if err := s.join(); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([][]byte, config.Keys)
+	for i := range values {
+		values[i] = []byte("churned value " + strconv.Itoa(i))
+		if _, _, err := s.randomNode().Put(values[i]); err != nil {
+			return nil, fmt.Errorf("failed to store value %d, error: %s", i, err)
+		}
+	}
+	s.probe(values)
+
+	for s.elapsed+tMaintenance <= config.Duration {
+		if err := s.step(); err != nil {
+			return nil, err
+		}
+
+		if s.elapsed%config.Probe == 0 {
+			s.probe(values)
+		}
+	}
+
+	s.report.Elapsed = time.Since(start)
+	return s.report, nil
+}
+
+func newChurnScenario(config ChurnConfig, start time.Time) *churnScenario {
+	return &churnScenario{
+		config:  config,
+		random:  rand.New(rand.NewSource(config.Seed)),
+		network: NewSimNetwork(config.Seed),
+		clock:   newVirtualClock(start),
+		report:  &ChurnReport{Config: config},
+	}
+}
+
+// Advance simulated time by tMaintenance. Nodes join and are killed as
+// due by the configured rates, and every node then runs the work of its
+// background loops.
+func (s *churnScenario) step() error {
+	s.clock.Advance(tMaintenance)
+	s.elapsed += tMaintenance
+
+	for s.report.Joined < int(s.config.JoinRate*s.elapsed.Hours()) {
+		if err := s.join(); err != nil {
+			return err
+		}
+		s.report.Joined++
+	}
+
+	for s.report.Killed < int(s.config.KillRate*s.elapsed.Hours()) && len(s.alive) > 1 {
+		s.kill(s.random.Intn(len(s.alive)))
+		s.report.Killed++
+	}
+
+	for _, dht := range s.alive {
+		dht.refreshBuckets()
+		dht.replicateKeys()
+		dht.republishKeys()
+		dht.sweepExpired()
+	}
+
+	return nil
+}
+
+// Add a node to the network, joining through a random live node
+func (s *churnScenario) join() error {
+	dht := s.network.NewDht(WithBucketSize(s.config.K), WithAlpha(s.config.Alpha), WithClock(s.clock))
+	go func() {
+		defer func() { dht.Done <- struct{}{} }()
+		dht.entry()
+	}()
+
+	if len(s.alive) > 0 {
+		buddy := s.randomNode().Node
+		if _, err := dht.join(buddy.Addr, buddy.Port); err != nil {
+			s.stop(dht)
+			return fmt.Errorf("node failed to join the network, error: %s", err)
+		}
+	}
+
+	s.alive = append(s.alive, dht)
+	return nil
+}
+
+// Kill the live node at the given index, which stops responding
+// without handing off its pairs or telling anyone
+func (s *churnScenario) kill(i int) {
+	s.stop(s.alive[i])
+	s.alive = append(s.alive[:i], s.alive[i+1:]...)
+}
+
+func (s *churnScenario) stop(dht *Dht) {
+	dht.Close()
+	<-dht.Done
+}
+
+func (s *churnScenario) stopAll() {
+	for _, dht := range s.alive {
+		s.stop(dht)
+	}
+	s.alive = nil
+}
+
+func (s *churnScenario) randomNode() *Dht {
+	return s.alive[s.random.Intn(len(s.alive))]
+}
+
+// Record how many of the values a random live node can retrieve
+func (s *churnScenario) probe(values [][]byte) int {
+	source := s.randomNode()
+	retrievable := 0
+	for _, value := range values {
+		key := Hash(value)
+		found, err := source.Data.Get(key)
+		if err != nil {
+			found = source.iterativeLookup(key, true).value
+		}
+
+		if bytes.Equal(found, value) {
+			retrievable++
+		}
+	}
+
+	s.report.Samples = append(s.report.Samples, ChurnSample{Time: s.elapsed, Nodes: len(s.alive), Retrievable: retrievable})
+	return retrievable
+}
+
+// Run a churn scenario for each combination of the given bucket sizes
+// and lookup parallelism, printing the report of each
+func runChurnScenarios(config ChurnConfig, ks []int, alphas []int) error {
+	for _, k := range ks {
+		for _, parallelism := range alphas {
+			config.K, config.Alpha = k, parallelism
+			report, err := RunChurn(config)
+			if err != nil {
+				return err
+			}
+
+			fmt.Print(report)
+		}
+	}
+
+	return nil
+}
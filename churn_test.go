@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Without churn, every pair should stay retrievable for two days, which
+// requires publishers to republish their pairs before they expire
+func TestChurnWithoutChurnKeepsPairs(t *testing.T) {
+	report, err := RunChurn(ChurnConfig{Nodes: 10, Keys: 5, Duration: 48 * time.Hour, Probe: 12 * time.Hour, K: 4, Alpha: 2, Seed: 1})
+	if err != nil {
+		t.Fatalf("Error running churn scenario, error: %s", err)
+	}
+
+	if len(report.Samples) != 5 {
+		t.Fatalf("Expected a sample every 12 hours including the start, got %d samples", len(report.Samples))
+	}
+
+	for _, sample := range report.Samples {
+		if sample.Retrievable != 5 || sample.Nodes != 10 {
+			t.Errorf("Expected all 5 pairs retrievable from 10 nodes at %s, got %d pairs from %d nodes",
+				sample.Time, sample.Retrievable, sample.Nodes)
+		}
+	}
+
+	if report.Durability() != 1 {
+		t.Errorf("Expected durability of 1, got %.2f", report.Durability())
+	}
+}
+
+// Nodes should join and be killed at the configured rates over
+// simulated time
+func TestChurnRates(t *testing.T) {
+	report, err := RunChurn(ChurnConfig{Nodes: 10, Keys: 2, Duration: 6 * time.Hour, JoinRate: 1, KillRate: 2, K: 4, Alpha: 2, Seed: 1})
+	if err != nil {
+		t.Fatalf("Error running churn scenario, error: %s", err)
+	}
+
+	if report.Joined != 6 || report.Killed != 12 {
+		t.Errorf("Expected 6 nodes joined and 12 killed, got %d joined and %d killed", report.Joined, report.Killed)
+	}
+
+	if last := report.Samples[len(report.Samples)-1]; last.Time != 6*time.Hour || last.Nodes != 4 {
+		t.Errorf("Expected 4 nodes alive after 6 hours, got %d at %s", last.Nodes, last.Time)
+	}
+}
+
+// Once its publisher is killed, a pair should be replicated among the
+// remaining nodes until tExpire passes, and then expire everywhere
+func TestChurnPairExpiresWithoutPublisher(t *testing.T) {
+	s := newChurnScenario(ChurnConfig{K: 3, Alpha: 2, Seed: 1}, time.Now())
+	defer s.stopAll()
+	for i := 0; i < 6; i++ {
+		if err := s.join(); err != nil {
+			t.Fatalf("Error joining network, error: %s", err)
+		}
+	}
+
+	values := [][]byte{[]byte("orphaned value")}
+	if _, _, err := s.alive[0].Put(values[0]); err != nil {
+		t.Fatalf("Error putting value, error: %s", err)
+	}
+	s.kill(0)
+
+	for s.elapsed < tExpire-tMaintenance {
+		s.step()
+	}
+	if s.probe(values) != 1 {
+		t.Errorf("Expected pair to be retrievable before it expires at %s", s.elapsed)
+	}
+
+	for s.elapsed < publishedExpiration()+tMaintenance {
+		s.step()
+	}
+	if s.probe(values) != 0 {
+		t.Errorf("Expected pair to expire without its publisher by %s", s.elapsed)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of the current time and of tickers, which all expiry,
+// replication, republishing and refresh logic is measured against,
+// so that it can be driven by simulated time rather than the wall
+// clock. Request timeouts are measured in real time regardless, as
+// messages take real time to arrive, even over a simulated network.
+type Clock interface {
+	Now() time.Time
+	NewTicker(interval time.Duration) Ticker
+}
+
+// Ticker delivering the time on its channel every interval, dropping
+// ticks for slow receivers, until it is stopped
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// Measure time against the given clock, rather than the wall clock
+func WithClock(clock Clock) DhtOption {
+	return func(d *Dht) {
+		d.clock = clock
+		d.Data.clock = clock
+	}
+}
+
+// Clock reading the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(interval time.Duration) Ticker {
+	return systemTicker{time.NewTicker(interval)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// Simulated time, which only moves when it is advanced. Tickers fire
+// as time is advanced past each of their intervals.
+type virtualClock struct {
+	mtx     sync.Mutex
+	now     time.Time
+	tickers map[*virtualTicker]bool
+}
+
+func newVirtualClock(start time.Time) *virtualClock {
+	return &virtualClock{now: start, tickers: make(map[*virtualTicker]bool)}
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) NewTicker(interval time.Duration) Ticker {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ticker := &virtualTicker{
+		clock:    c,
+		interval: interval,
+		next:     c.now.Add(interval),
+		c:        make(chan time.Time, 1),
+	}
+	c.tickers[ticker] = true
+	return ticker
+}
+
+// Move time forward, firing each ticker whose next tick has come.
+// As with tickers on the wall clock, a ticker whose receiver has not
+// taken its last tick drops further ticks.
+func (c *virtualClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+	for ticker := range c.tickers {
+		for !ticker.next.After(c.now) {
+			select {
+			case ticker.c <- ticker.next:
+			default:
+			}
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+	}
+}
+
+type virtualTicker struct {
+	clock    *virtualClock
+	interval time.Duration
+	next     time.Time
+	c        chan time.Time
+}
+
+func (t *virtualTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *virtualTicker) Stop() {
+	t.clock.mtx.Lock()
+	defer t.clock.mtx.Unlock()
+	delete(t.clock.tickers, t)
+}
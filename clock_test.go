@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Get a fake clock for tests, which stands still until advanced
+func newFakeClock() *virtualClock {
+	return newVirtualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func TestFakeClockAdvances(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	clock.Advance(48 * time.Hour)
+
+	if elapsed := clock.Now().Sub(start); elapsed != 48*time.Hour {
+		t.Errorf("Expected clock to advance by 48h, advanced by %s", elapsed)
+	}
+}
+
+// Tickers should fire once their interval has passed, drop ticks
+// nobody received, and stop firing once stopped
+func TestFakeClockTickers(t *testing.T) {
+	clock := newFakeClock()
+	ticker := clock.NewTicker(time.Minute)
+
+	clock.Advance(59 * time.Second)
+	if len(ticker.Chan()) != 0 {
+		t.Errorf("Ticker should not fire before its interval passes")
+	}
+
+	clock.Advance(time.Second)
+	if tick := <-ticker.Chan(); !tick.Equal(clock.Now()) {
+		t.Errorf("Expected tick at %s, got %s", clock.Now(), tick)
+	}
+
+	clock.Advance(10 * time.Minute)
+	<-ticker.Chan()
+	if len(ticker.Chan()) != 0 {
+		t.Errorf("Ticker should drop ticks nobody received")
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	if len(ticker.Chan()) != 0 {
+		t.Errorf("Ticker should not fire after being stopped")
+	}
+}
+
+// Pairs should expire, and be due for replication and republishing,
+// as the clock of the store advances
+func TestKVStoreTimeoutsFollowClock(t *testing.T) {
+	clock := newFakeClock()
+	kvstore := NewKVStore()
+	kvstore.clock = clock
+
+	replica, published := []byte("replica"), []byte("published")
+	kvstore.Set(Hash(replica), replica, clock.Now().Add(tExpire), tReplicate)
+	kvstore.Publish(Hash(published), published, clock.Now().Add(publishedExpiration()), tReplicate)
+
+	clock.Advance(tReplicate)
+	if keys := kvstore.GetKeysForReplicaion(); len(keys) != 0 {
+		t.Errorf("No pair should be due for replication until tReplicate has passed, got %d", len(keys))
+	}
+
+	clock.Advance(time.Second)
+	if keys := kvstore.GetKeysForReplicaion(); len(keys) != 1 {
+		t.Errorf("Replica should be due for replication after tReplicate, got %d keys", len(keys))
+	}
+
+	kvstore.MarkReplicated(Hash(replica))
+	if keys := kvstore.GetKeysForReplicaion(); len(keys) != 0 {
+		t.Errorf("Replicated pair should not be due for replication, got %d keys", len(keys))
+	}
+
+	clock.Advance(tRepublish - tReplicate)
+	if keys := kvstore.GetKeysForRepublishing(); len(keys) != 1 {
+		t.Errorf("Published pair should be due for republishing after tRepublish, got %d keys", len(keys))
+	}
+
+	if flushed := kvstore.FlushExpiredPairs(); flushed != 1 {
+		t.Errorf("Replica should be flushed after tExpire, %d pairs flushed", flushed)
+	}
+}
+
+// The background sweeper should purge pairs once the clock of the
+// dht passes their expiration
+func TestSweeperFollowsClock(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDht(WithClock(clock))
+	defer d.Close()
+	d.startSweeper()
+
+	data := []byte("expiring")
+	d.Data.Set(Hash(data), data, clock.Now().Add(time.Hour), tReplicate)
+
+	clock.Advance(time.Hour)
+	if _, err := d.Data.Get(Hash(data)); err != nil {
+		t.Fatalf("Pair should not be purged before it expires")
+	}
+
+	clock.Advance(tMaintenance)
+	waitFor(t, time.Second, func() bool {
+		_, err := d.Data.Get(Hash(data))
+		return err != nil
+	})
+}
+
+// Buckets should become stale once tRefresh passes on the clock of
+// the dht, without a lookup in their range
+func TestRefreshFollowsClock(t *testing.T) {
+	clock := newFakeClock()
+	dhts, _ := startSimDhts(2, WithClock(clock))
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	if refreshed := dhts[1].refreshBuckets(); refreshed != 0 {
+		t.Errorf("No bucket should be stale on starting, got %d refreshed", refreshed)
+	}
+
+	clock.Advance(tRefresh)
+	if refreshed := dhts[1].refreshBuckets(); refreshed == 0 {
+		t.Errorf("Buckets should be stale after tRefresh")
+	}
+
+	if refreshed := dhts[1].refreshBuckets(); refreshed != 0 {
+		t.Errorf("Refreshed buckets should be fresh, got %d refreshed", refreshed)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Codec writing messages onto connections, and reading them back
+type Codec interface {
+	Encode(w io.Writer, msg *Message) error
+	Decode(r io.Reader) (*Message, error)
+}
+
+// Largest frame body accepted by the binary codec, in bytes. Frames
+// announcing a larger body are rejected before the body is read.
+const maxFrameSize = 64 * 1024
+
+// Encode messages with the given codec, rather than the binary codec.
+// Every node in a network must use the same codec.
+func WithCodec(codec Codec) DhtOption {
+	return func(d *Dht) {
+		d.codec = codec
+	}
+}
+
+// Get the codec with the given name, either binary or gob
+func codecByName(name string) (Codec, error) {
+	switch name {
+	case "binary":
+		return BinaryCodec{}, nil
+	case "gob":
+		return GobCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+// Codec encoding messages with encoding/gob, which only Go nodes can
+// read. Kept for migrating networks of nodes which still use it. Gob
+// decodes empty byte strings as nil, so empty values cannot be found
+// over it.
+type GobCodec struct{}
+
+func (GobCodec) Encode(w io.Writer, msg *Message) error {
+	return gob.NewEncoder(w).Encode(msg)
+}
+
+func (GobCodec) Decode(r io.Reader) (*Message, error) {
+	msg := &Message{}
+	if err := gob.NewDecoder(r).Decode(msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Codec encoding each message as a length prefixed frame. Integers
+// are big endian, and byte strings are a uint32 length followed by
+// that many bytes, where an empty string decodes as nil. The frame is
+//
+//	uint32     length of the body, at most maxFrameSize
+//	body:
+//	uint16     Version
+//	uint32     Capabilities
+//	uint8      Type
+//	uint8      flags, 0x1 Pong, 0x2 Response, 0x4 Sender present,
+//	           0x8 Cached, 0x10 Value present
+//	bytes      MsgId
+//	node       Sender, only if present
+//	bytes      Key
+//	bytes      Data
+//	int64      ReplicationInterval, in nanoseconds
+//	bytes      Value, which decodes as empty rather than nil if present
+//	int64      ExpirationTime, in nanoseconds since the Unix epoch,
+//	           or 0 if unset
+//	uint32     number of nodes in KNearestNodes, followed by each node
+//	bytes      Signature, over all of the body before it
+//
+// where each node is
+//
+//	bytes      Id
+//	bytes      PublicKey
+//	bytes      Nonce
+//	bytes      Addr, 4 bytes for IPv4, 16 bytes for IPv6, or empty
+//	uint16     Port
+//	uint16     Version
+//	uint32     Capabilities
+//	uint8      static puzzle Difficulty
+//	uint8      dynamic puzzle Difficulty
+//
+// Decoding fails if the body is truncated or has bytes left over.
+type BinaryCodec struct{}
+
+const (
+	flagPong     = 0x1
+	flagResponse = 0x2
+	flagSender   = 0x4
+	flagCached   = 0x8
+	flagValue    = 0x10
+)
+
+func (BinaryCodec) Encode(w io.Writer, msg *Message) error {
+	body := encodeBody(msg)
+	body.bytes(msg.Signature)
+	if body.Len() > maxFrameSize {
+		return fmt.Errorf("message of %d bytes exceeds max frame size of %d bytes", body.Len(), maxFrameSize)
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(body.Len()))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+// Encode every field of the message into a frame body, other than
+// the signature, which is made over the fields encoded here
+func encodeBody(msg *Message) *frameWriter {
+	body := &frameWriter{}
+	body.uint16(msg.Version)
+	body.uint32(uint32(msg.Capabilities))
+	body.uint8(uint8(msg.Type))
+
+	var flags uint8
+	if msg.Pong {
+		flags |= flagPong
+	}
+	if msg.Response {
+		flags |= flagResponse
+	}
+	if msg.Sender != nil {
+		flags |= flagSender
+	}
+	if msg.Cached {
+		flags |= flagCached
+	}
+	if msg.Value != nil {
+		flags |= flagValue
+	}
+	body.uint8(flags)
+
+	body.bytes(msg.MsgId)
+	if msg.Sender != nil {
+		body.node(msg.Sender)
+	}
+	body.bytes(msg.Key)
+	body.bytes(msg.Data)
+	body.int64(int64(msg.ReplicationInterval))
+	body.bytes(msg.Value)
+	if msg.ExpirationTime.IsZero() {
+		body.int64(0)
+	} else {
+		body.int64(msg.ExpirationTime.UnixNano())
+	}
+
+	body.uint32(uint32(len(msg.KNearestNodes)))
+	for _, node := range msg.KNearestNodes {
+		body.node(node)
+	}
+
+	return body
+}
+
+func (BinaryCodec) Decode(r io.Reader) (*Message, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds max frame size of %d bytes", size, maxFrameSize)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	body := &frameReader{data: data}
+	msg := &Message{
+		Version:      body.uint16(),
+		Capabilities: Capabilities(body.uint32()),
+		Type:         MessageType(body.uint8()),
+	}
+	flags := body.uint8()
+	msg.Pong = flags&flagPong != 0
+	msg.Response = flags&flagResponse != 0
+	msg.Cached = flags&flagCached != 0
+
+	msg.MsgId = body.bytes()
+	if flags&flagSender != 0 {
+		msg.Sender = body.node()
+	}
+	msg.Key = body.bytes()
+	msg.Data = body.bytes()
+	msg.ReplicationInterval = time.Duration(body.int64())
+	msg.Value = body.bytes()
+	if flags&flagValue != 0 && msg.Value == nil {
+		msg.Value = []byte{}
+	}
+	if expiration := body.int64(); expiration != 0 {
+		msg.ExpirationTime = time.Unix(0, expiration)
+	}
+
+	// Each node takes at least 26 bytes, which bounds the count
+	// before allocating for it
+	count := body.uint32()
+	if body.err == nil && int64(count)*26 > int64(len(body.data)) {
+		body.err = errTruncatedFrame
+	}
+	for i := uint32(0); i < count && body.err == nil; i++ {
+		msg.KNearestNodes = append(msg.KNearestNodes, body.node())
+	}
+	msg.Signature = body.bytes()
+
+	if body.err != nil {
+		return nil, body.err
+	}
+	if len(body.data) > 0 {
+		return nil, fmt.Errorf("frame has %d bytes left over", len(body.data))
+	}
+
+	return msg, nil
+}
+
+var errTruncatedFrame = errors.New("frame is truncated")
+
+// Buffer a frame body is written into
+type frameWriter struct {
+	bytes.Buffer
+}
+
+func (w *frameWriter) uint8(v uint8) {
+	w.WriteByte(v)
+}
+
+func (w *frameWriter) uint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *frameWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *frameWriter) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.Write(b[:])
+}
+
+func (w *frameWriter) bytes(v []byte) {
+	w.uint32(uint32(len(v)))
+	w.Write(v)
+}
+
+func (w *frameWriter) node(node *Node) {
+	w.bytes(node.Id)
+	w.bytes(node.PublicKey)
+	w.bytes(node.Nonce)
+	if ip := node.Addr.To4(); ip != nil {
+		w.bytes(ip)
+	} else {
+		w.bytes(node.Addr)
+	}
+	w.uint16(uint16(node.Port))
+	w.uint16(node.Version)
+	w.uint32(uint32(node.Capabilities))
+	w.uint8(node.Difficulty.Static)
+	w.uint8(node.Difficulty.Dynamic)
+}
+
+// Reader over a frame body, which records the first error hit, after
+// which every read returns the zero value
+type frameReader struct {
+	data []byte
+	err  error
+}
+
+func (r *frameReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errTruncatedFrame
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *frameReader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *frameReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *frameReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *frameReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *frameReader) bytes() []byte {
+	n := r.uint32()
+	if n == 0 {
+		return nil
+	}
+	if uint64(n) > uint64(len(r.data)) {
+		r.err = errTruncatedFrame
+		return nil
+	}
+
+	return r.next(int(n))
+}
+
+func (r *frameReader) node() *Node {
+	node := &Node{Id: r.bytes(), PublicKey: r.bytes(), Nonce: r.bytes()}
+	switch addr := r.bytes(); len(addr) {
+	case 0:
+	case net.IPv4len, net.IPv6len:
+		node.Addr = net.IP(addr)
+	default:
+		r.err = fmt.Errorf("node address of %d bytes", len(addr))
+	}
+	node.Port = int(r.uint16())
+	node.Version = r.uint16()
+	node.Capabilities = Capabilities(r.uint32())
+	node.Difficulty.Static = r.uint8()
+	node.Difficulty.Dynamic = r.uint8()
+	return node
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func fullMessage() *Message {
+	return &Message{
+		Version:             protocolVersion,
+		Capabilities:        supportedCapabilities,
+		Type:                StoreMsg,
+		MsgId:               []byte{1, 2, 3},
+		Sender:              &Node{Id: Hash([]byte("sender")), Addr: net.ParseIP("10.0.0.1").To4(), Port: 4001, Version: 2, Capabilities: 3, Difficulty: PuzzleDifficulty{4, 8}, Nonce: Hash([]byte("nonce"))},
+		Key:                 Hash([]byte("key")),
+		Data:                []byte("data"),
+		ReplicationInterval: tReplicate,
+		Value:               []byte("value"),
+		ExpirationTime:      time.Unix(1600000000, 42),
+		Pong:                true,
+		Response:            true,
+		Cached:              true,
+		KNearestNodes: []*Node{
+			{Id: Hash([]byte("a")), Addr: net.ParseIP("10.0.0.2").To4(), Port: 4002},
+			{Id: Hash([]byte("b")), Addr: net.ParseIP("::1"), Port: 4003},
+		},
+	}
+}
+
+// Messages should decode to what was encoded, with both codecs
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{BinaryCodec{}, GobCodec{}} {
+		for _, msg := range []*Message{fullMessage(), {Type: PingMsg, MsgId: []byte{1}}} {
+			var buf bytes.Buffer
+			if err := codec.Encode(&buf, msg); err != nil {
+				t.Fatalf("Error encoding with %T, error: %s", codec, err)
+			}
+
+			decoded, err := codec.Decode(&buf)
+			if err != nil {
+				t.Fatalf("Error decoding with %T, error: %s", codec, err)
+			}
+
+			if !decoded.ExpirationTime.Equal(msg.ExpirationTime) {
+				t.Errorf("Expected expiration %s with %T, got %s", msg.ExpirationTime, codec, decoded.ExpirationTime)
+			}
+			decoded.ExpirationTime = msg.ExpirationTime
+
+			if !reflect.DeepEqual(decoded, msg) {
+				t.Errorf("Expected %+v with %T, got %+v", msg, codec, decoded)
+			}
+		}
+	}
+}
+
+// The binary encoding is fixed, so that other implementations can
+// read and write it
+func TestBinaryCodecEncoding(t *testing.T) {
+	msg := &Message{
+		Version:      1,
+		Capabilities: CapLeave,
+		Type:         PingMsg,
+		MsgId:        []byte{0xaa, 0xbb},
+		Sender:       &Node{Id: []byte{0x01}, Nonce: []byte{0x02}, Addr: net.ParseIP("127.0.0.1"), Port: 4000, Version: 1, Capabilities: CapLeave, Difficulty: PuzzleDifficulty{1, 2}},
+	}
+
+	var buf bytes.Buffer
+	if err := (BinaryCodec{}).Encode(&buf, msg); err != nil {
+		t.Fatalf("Error encoding message, error: %s", err)
+	}
+
+	expected := "00000052" + // body length
+		"0001" + "00000001" + // version, capabilities
+		"01" + "04" + // type, flags
+		"00000002aabb" + // MsgId
+		"0000000101" + "00000000" + "0000000102" + "000000047f000001" + "0fa0" + "0001" + "00000001" + "01" + "02" + // Sender
+		"00000000" + "00000000" + // Key, Data
+		"0000000000000000" + // ReplicationInterval
+		"00000000" + // Value
+		"0000000000000000" + // ExpirationTime
+		"00000000" + // KNearestNodes
+		"00000000" // Signature
+	if encoded := hex.EncodeToString(buf.Bytes()); encoded != expected {
+		t.Errorf("Expected encoding %s, got %s", expected, encoded)
+	}
+}
+
+// Reader which fails the test if it is read from
+type unreadable struct {
+	t *testing.T
+}
+
+func (r unreadable) Read(b []byte) (int, error) {
+	r.t.Errorf("Body of oversized frame should not be read")
+	return 0, io.EOF
+}
+
+// Frames larger than the max frame size should be rejected, before
+// their body is read
+func TestBinaryCodecRejectsOversizedFrames(t *testing.T) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, maxFrameSize+1)
+	if _, err := (BinaryCodec{}).Decode(io.MultiReader(bytes.NewReader(header), unreadable{t})); err == nil {
+		t.Errorf("Expected oversized frame to be rejected")
+	}
+
+	msg := &Message{Type: StoreMsg, Data: make([]byte, maxFrameSize)}
+	if err := (BinaryCodec{}).Encode(&bytes.Buffer{}, msg); err == nil {
+		t.Errorf("Expected oversized message to be rejected")
+	}
+}
+
+// Malformed frames should fail to decode
+func TestBinaryCodecRejectsMalformedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (BinaryCodec{}).Encode(&buf, fullMessage()); err != nil {
+		t.Fatalf("Error encoding message, error: %s", err)
+	}
+	frame := buf.Bytes()
+
+	buf.Reset()
+	if err := (BinaryCodec{}).Encode(&buf, &Message{Type: FindNodeMsg}); err != nil {
+		t.Fatalf("Error encoding message, error: %s", err)
+	}
+	withoutNodes := buf.Bytes()[4 : buf.Len()-4]
+
+	withBody := func(body []byte) []byte {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(body)))
+		return append(header, body...)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":            {},
+		"partial header":   frame[:2],
+		"short body":       frame[:len(frame)-1],
+		"truncated body":   withBody(frame[4 : len(frame)-1]),
+		"trailing bytes":   withBody(append(append([]byte{}, frame[4:]...), 0)),
+		"too many nodes":   withBody(append(withoutNodes, 0xff, 0xff, 0xff, 0xff)),
+		"bad node address": withBody([]byte{0, 1, 0, 0, 0, 1, 1, flagSender, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 1, 2, 3, 0, 0, 0, 1, 0, 0, 0, 1}),
+	} {
+		if _, err := (BinaryCodec{}).Decode(bytes.NewReader(data)); err == nil {
+			t.Errorf("Expected %s frame to fail to decode", name)
+		}
+	}
+
+	// A connection closed before any frame is sent ends cleanly
+	if _, err := (BinaryCodec{}).Decode(bytes.NewReader(nil)); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF decoding empty stream, got %v", err)
+	}
+}
+
+// Nodes using the gob codec should still be able to talk to each other
+func TestGobCodecNetwork(t *testing.T) {
+	dhts, _ := startSimDhts(2, WithCodec(GobCodec{}))
+	defer stopDhts(dhts)
+
+	if err := dhts[1].pingNode(dhts[0].Node); err != nil {
+		t.Errorf("Error pinging node over gob codec, error: %s", err)
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for name, expected := range map[string]Codec{"binary": BinaryCodec{}, "gob": GobCodec{}} {
+		if codec, err := codecByName(name); err != nil || codec != expected {
+			t.Errorf("Expected %T for %q, got %T with error %v", expected, name, codec, err)
+		}
+	}
+
+	if _, err := codecByName("json"); err == nil {
+		t.Errorf("Expected error for unknown codec")
+	}
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
-	"encoding/gob"
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // DHT struct wraps key value store and node
@@ -22,7 +31,38 @@ type Dht struct {
 	Data       *kvstore
 	Node       *Node
 	Buckets    [][]*Node
-	Listener   net.Listener
+	// Recently seen nodes which did not fit into their full
+	// bucket, kept to replace unresponsive nodes in the bucket
+	Replacements [][]*Node
+	Listener     net.Listener
+	Transport    Transport
+	pending      *pendingRequests
+	evicting     map[int]bool
+	// Time of the last lookup for an ID in the range of each bucket
+	lastLookup []time.Time
+	quit       chan struct{}
+	stopOnce   sync.Once
+	loops      sync.WaitGroup
+	leaving    bool
+	// Time to wait for other nodes to respond to our requests
+	rpcTimeout time.Duration
+	// Maximum nodes in a bucket, which is also the number of
+	// closest nodes located by lookups and storing each pair
+	k int
+	// Number of requests sent in parallel by lookups
+	alpha int
+	// Number of disjoint paths each lookup is split over
+	paths int
+	// Clock which timeouts are measured against
+	clock Clock
+	// Codec messages are written and read with
+	codec Codec
+	// Private key messages from this node are signed with, and
+	// whether it was given rather than generated
+	privateKey ed25519.PrivateKey
+	keyGiven   bool
+	// Whether connections are encrypted with TLS
+	encrypted bool
 }
 
 func (d *Dht) formPingMsg(pong bool) *Message {
@@ -34,22 +74,37 @@ func (d *Dht) formPingMsg(pong bool) *Message {
 	}
 }
 
-func (k *Dht) formFindKeyMsg(key string) *Message {
+func (k *Dht) formFindKeyMsg(key []byte) *Message {
 	return &Message{
 		Type:   FindValueMsg,
 		MsgId:  GenerateMsgId(),
 		Sender: k.Node,
-		Key:    []byte(key),
+		Key:    key,
 	}
 }
 
-func (k *Dht) formStoreMsg(value string) *Message {
+func (d *Dht) formFindNodeMsg(target []byte) *Message {
 	return &Message{
-		Type:   StoreMsg,
+		Type:   FindNodeMsg,
 		MsgId:  GenerateMsgId(),
-		Sender: k.Node,
-		Key:    Hash([]byte(value)),
-		Data:   []byte(value),
+		Sender: d.Node,
+		Key:    target,
+	}
+}
+
+func (k *Dht) formStoreMsg(value string) *Message {
+	return k.formStoreKeyMsg(Hash([]byte(value)), []byte(value))
+}
+
+func (k *Dht) formStoreKeyMsg(key []byte, value []byte) *Message {
+	return &Message{
+		Type:                StoreMsg,
+		MsgId:               GenerateMsgId(),
+		Sender:              k.Node,
+		Key:                 key,
+		Data:                value,
+		ExpirationTime:      k.clock.Now().Add(tExpire),
+		ReplicationInterval: tReplicate,
 	}
 }
 
@@ -85,6 +140,52 @@ func (d *Dht) getHighestAllowableBucketIndex(otherId []byte) int {
 	return 0
 }
 
+// Generate a random ID which falls into the bucket with the given
+// index, by flipping the bit of our own ID at the index, and taking
+// random values for all less significant bits.
+func (d *Dht) randomIdInBucket(index int) []byte {
+	id := make([]byte, keysize)
+	rand.Read(id)
+	for bit := index; bit < numBuckets; bit++ {
+		byteIndex, mask := keysize-1-bit/8, byte(1<<(bit%8))
+		id[byteIndex] = id[byteIndex]&^mask | d.Node.Id[byteIndex]&mask
+		if bit == index {
+			id[byteIndex] ^= mask
+		}
+	}
+
+	return id
+}
+
+// Summary of the routing table, giving the number of contacts and
+// replacement candidates held across all buckets, and in each bucket
+type RoutingTableStats struct {
+	Contacts     int
+	Replacements int
+	Buckets      []BucketStats
+}
+
+type BucketStats struct {
+	Contacts     int
+	Replacements int
+}
+
+func (d *Dht) Stats() RoutingTableStats {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	stats := RoutingTableStats{Buckets: make([]BucketStats, numBuckets)}
+	for i := range d.Buckets {
+		stats.Buckets[i] = BucketStats{
+			Contacts:     len(d.Buckets[i]),
+			Replacements: len(d.Replacements[i]),
+		}
+		stats.Contacts += len(d.Buckets[i])
+		stats.Replacements += len(d.Replacements[i])
+	}
+
+	return stats
+}
+
 func (d *Dht) nodeCount() int {
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
@@ -99,8 +200,23 @@ func (d *Dht) nodeCount() int {
 // Helper to place a node in one of the k-buckets, based on
 // the distance from this node to the other. The k-buckets are
 // sorted by the most to least recent communication with each
-// node in the bucket.
+// node in the bucket. When the bucket is full, we favour the
+// long-lived nodes already in the bucket, and only replace the
+// least recently seen node if it fails to respond to a ping.
+// Nodes of incompatible protocol versions are never placed.
 func (d *Dht) addToKBucket(other *Node) {
+	if !compatibleVersion(other.Version) {
+		writeLog("Not placing node %s of incompatible protocol version %d\n", other.AddressString(), other.Version)
+		return
+	}
+
+	if other.Difficulty != d.Node.Difficulty || !other.solvesPuzzles(d.Node.Difficulty) {
+		writeLog("Not placing node %s, which does not solve the crypto puzzles at our difficulty\n", other.AddressString())
+		return
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
 	bucketIndex := d.getHighestAllowableBucketIndex(other.Id)
 
 	writeLog("placing node in bucket %d\n", bucketIndex)
@@ -110,119 +226,351 @@ func (d *Dht) addToKBucket(other *Node) {
 	// Move existing entry to the front of the list, if exists
 	for i, entry := range bucket {
 		if entry.equals(other) {
-			d.Buckets[bucketIndex] = append([]*Node{other}, append(bucket[:i], bucket[i+1:]...)...)
+			rest := append(append([]*Node{}, bucket[:i]...), bucket[i+1:]...)
+			d.Buckets[bucketIndex] = append([]*Node{other}, rest...)
+			return
 		}
 	}
 
-	if len(bucket) == maxNodesInBucket {
-		// If bucket is full, remove the last entry, replace
-		// with the new Node
-		d.Buckets[bucketIndex] = append([]*Node{other}, bucket[:len(bucket)-1]...)
-	} else {
+	if len(bucket) < d.k {
 		d.Buckets[bucketIndex] = append([]*Node{other}, bucket...)
+		d.removeReplacement(bucketIndex, other)
+		return
+	}
+
+	// If bucket is full, keep the new node as a replacement candidate,
+	// and ping the least recently seen node in the background, unless
+	// we are already doing so for this bucket, or are shutting down
+	d.addReplacement(bucketIndex, other)
+	if d.evicting[bucketIndex] || d.stopping() {
+		return
+	}
+
+	d.evicting[bucketIndex] = true
+	leastRecent := bucket[len(bucket)-1]
+	d.loops.Add(1)
+	go func() {
+		defer d.loops.Done()
+		d.evictIfUnresponsive(bucketIndex, leastRecent)
+	}()
+}
+
+// Ping the least recently seen node in a full bucket, and if it fails
+// to respond, evict it in favour of the most recently seen replacement
+// candidate for the bucket. If it does respond, the pong moves it to
+// the front of the bucket, and the candidates stay in the cache.
+func (d *Dht) evictIfUnresponsive(bucketIndex int, leastRecent *Node) {
+	err := d.pingNode(leastRecent)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.evicting[bucketIndex] = false
+	if err == nil {
+		return
+	}
+
+	writeLog("evicting unresponsive node %v from bucket %d\n", leastRecent.Id, bucketIndex)
+	d.removeFromKBucket(bucketIndex, leastRecent)
+}
+
+// Remove a node from its bucket, promoting the most recently seen
+// replacement candidate for the bucket in its place. Must be called
+// with the lock held.
+func (d *Dht) removeFromKBucket(bucketIndex int, other *Node) {
+	bucket := d.Buckets[bucketIndex]
+	for i, entry := range bucket {
+		if entry.equals(other) {
+			d.Buckets[bucketIndex] = append(append([]*Node{}, bucket[:i]...), bucket[i+1:]...)
+			break
+		}
+	}
+
+	replacements := d.Replacements[bucketIndex]
+	if len(d.Buckets[bucketIndex]) < d.k && len(replacements) > 0 {
+		writeLog("promoting replacement node %v to bucket %d\n", replacements[0].Id, bucketIndex)
+		d.Buckets[bucketIndex] = append([]*Node{replacements[0]}, d.Buckets[bucketIndex]...)
+		d.Replacements[bucketIndex] = replacements[1:]
+	}
+}
+
+// Place a node at the front of the replacement cache for a full
+// bucket, dropping the least recently seen candidate if the cache
+// is full. Must be called with the lock held.
+func (d *Dht) addReplacement(bucketIndex int, other *Node) {
+	d.removeReplacement(bucketIndex, other)
+	replacements := append([]*Node{other}, d.Replacements[bucketIndex]...)
+	if len(replacements) > maxReplacementsInBucket {
+		replacements = replacements[:maxReplacementsInBucket]
+	}
+
+	d.Replacements[bucketIndex] = replacements
+}
+
+// Remove a node from the replacement cache for a bucket, if it
+// is present. Must be called with the lock held.
+func (d *Dht) removeReplacement(bucketIndex int, other *Node) {
+	replacements := d.Replacements[bucketIndex]
+	for i, entry := range replacements {
+		if entry.equals(other) {
+			d.Replacements[bucketIndex] = append(append([]*Node{}, replacements[:i]...), replacements[i+1:]...)
+			return
+		}
 	}
 }
 
-func (d *Dht) FindValue(ReqMsg *Message) error {
+// Serve a FIND_VALUE request, replying with the value if it is
+// held in our store, and otherwise with the k nodes from our
+// buckets which are closest to the requested key
+func (d *Dht) FindValue(ReqMsg *Message) (*Message, error) {
 	writeLog("Serving find value with ID %v\n", ReqMsg.MsgId)
-	_ = &Message{
+
+	d.addToKBucket(ReqMsg.Sender)
+
+	resp := &Message{
 		Type:   FindValueMsg,
 		MsgId:  ReqMsg.MsgId,
 		Sender: d.Node,
-		Value:  nil,
+		Key:    ReqMsg.Key,
 	}
 
-	return nil
+	if value, err := d.Data.Get(ReqMsg.Key); err == nil {
+		resp.Value = value
+	} else {
+		resp.KNearestNodes = d.getKNearestNodes(ReqMsg.Key, ReqMsg.Sender)
+	}
+
+	return resp, nil
 }
 
-func (d *Dht) FindNode(ReqMsg *Message) error {
+// Serve a FIND_NODE request, replying with the k nodes from
+// our buckets which are closest to the requested target ID
+func (d *Dht) FindNode(ReqMsg *Message) (*Message, error) {
 	writeLog("Serving find node with ID %v\n", ReqMsg.MsgId)
-	_ = &Message{
-		Type:   FindValueMsg,
-		MsgId:  ReqMsg.MsgId,
-		Sender: d.Node,
-		Value:  nil,
-	}
 
-	return nil
+	d.addToKBucket(ReqMsg.Sender)
+
+	return &Message{
+		Type:          FindNodeMsg,
+		MsgId:         ReqMsg.MsgId,
+		Sender:        d.Node,
+		Key:           ReqMsg.Key,
+		KNearestNodes: d.getKNearestNodes(ReqMsg.Key, ReqMsg.Sender),
+	}, nil
 }
 
-func (d *Dht) Ping(ReqMsg *Message) error {
+// Serve a PING request, replying with a pong
+func (d *Dht) Ping(ReqMsg *Message) (*Message, error) {
 	writeLog("Serving ping with ID %v\n", ReqMsg.MsgId)
 
 	d.addToKBucket(ReqMsg.Sender)
 
-	if !ReqMsg.Pong {
-		// This is ping from another node, so we need to send pong
-		resp := &Message{
-			Type:   PingMsg,
-			MsgId:  ReqMsg.MsgId,
-			Sender: d.Node,
-			Pong:   true}
-		d.sendMessageHost(resp, ReqMsg.Sender.Addr, ReqMsg.Sender.Port)
-	} else {
-		// This is response to our ping
-		writeLog("Pong from %v\n", ReqMsg.Sender.Id)
-	}
-
-	return nil
+	return &Message{
+		Type:   PingMsg,
+		MsgId:  ReqMsg.MsgId,
+		Sender: d.Node,
+		Pong:   true,
+	}, nil
 }
 
-func (d *Dht) Store(ReqMsg *Message) error {
+// Serve a STORE request, setting the pair in our store and replying
+// to acknowledge that the pair was accepted. The pair expires at the
+// time requested by the sender, unless we are outside the k closest
+// nodes to the key, in which case the pair is a cached copy, and its
+// expiration is scaled down by our distance from the key.
+func (d *Dht) Store(ReqMsg *Message) (*Message, error) {
 	writeLog("Serving store with ID %v\n", ReqMsg.MsgId)
-	d.Data.Set(ReqMsg.Key, ReqMsg.Data, ReqMsg.ExpirationTime, ReqMsg.ReplicationInterval)
 
-	_ = &Message{
+	d.addToKBucket(ReqMsg.Sender)
+
+	// Only cached copies expire sooner the further we are from the key.
+	// Contacts which left the network may still be counted as closer,
+	// so copies stored by the nodes closest to the key are never cut short.
+	expirationTime := ReqMsg.ExpirationTime
+	if ReqMsg.Cached {
+		if closer := d.closerNodeCount(ReqMsg.Key); closer >= d.k {
+			if scaled := d.clock.Now().Add(cachedExpiration(closer, d.k)); scaled.Before(expirationTime) {
+				expirationTime = scaled
+			}
+		}
+	}
+
+	if ReqMsg.Cached {
+		d.Data.Cache(ReqMsg.Key, ReqMsg.Data, expirationTime, ReqMsg.ReplicationInterval)
+	} else {
+		d.Data.Set(ReqMsg.Key, ReqMsg.Data, expirationTime, ReqMsg.ReplicationInterval)
+	}
+
+	return &Message{
 		Type:          StoreMsg,
 		MsgId:         ReqMsg.MsgId,
 		Sender:        d.Node,
-		Value:         nil,
-		KNearestNodes: d.getKNearestNodes(ReqMsg.Key),
+		Key:           ReqMsg.Key,
+		KNearestNodes: d.getKNearestNodes(ReqMsg.Key, ReqMsg.Sender),
+	}, nil
+}
+
+// Count the nodes in our k-buckets which are closer to the key than we
+// are. Our buckets cover the nodes near us densely, so this estimates
+// the number of nodes between us and the node closest to the key.
+func (d *Dht) closerNodeCount(key []byte) int {
+	target := &Node{Id: key}
+	ownDistance := d.Node.distance(target)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	count := 0
+	for _, bucket := range d.Buckets {
+		for _, node := range bucket {
+			if node.distance(target).Cmp(ownDistance) < 0 {
+				count++
+			}
+		}
 	}
 
-	return nil
+	return count
 }
 
-// Return the k nearest nodes by ID to the given key
-func (d *Dht) getKNearestNodes(key []byte) []*Node {
-	return nil
+// Time for which a cached copy of a pair should live, given the number
+// of nodes closer to its key than we are, which is at least k. The
+// lifetime halves with each node between us and the k closest nodes,
+// down to the sweeper interval, as the sweeper would not notice any
+// shorter lifetime.
+func cachedExpiration(closer int, k int) time.Duration {
+	expiration := tExpire
+	for i := k; i <= closer && expiration > tMaintenance; i++ {
+		expiration /= 2
+	}
+
+	if expiration < tMaintenance {
+		return tMaintenance
+	}
+
+	return expiration
 }
 
-// Sends message to host specified by IP/port
-func (d *Dht) sendMessageHost(resp *Message, IP net.IP, port int) error {
-	return d.sendMessage(resp, fmt.Sprintf("%s:%s", IP.String(), fmt.Sprint(port)))
+// Return the k nearest nodes by ID to the given key, excluding the
+// requesting node if given. Every node in bucket j has a distance
+// from this node in [2^j, 2^(j+1)), so the nodes in the bucket the
+// key falls into are closest to the key, followed by the nodes in all
+// lower buckets, which share a distance band to the key. Each higher
+// bucket then forms its own band, further from the key than the last,
+// so we stop gathering candidates once we have k of them.
+func (d *Dht) getKNearestNodes(key []byte, exclude *Node) []*Node {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	var nodes []*Node
+	gather := func(bucket []*Node) {
+		for _, node := range bucket {
+			if exclude == nil || !bytes.Equal(node.Id, exclude.Id) {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	bucketIndex := d.getHighestAllowableBucketIndex(key)
+	for i := bucketIndex; i >= 0; i-- {
+		gather(d.Buckets[i])
+	}
+
+	for i := bucketIndex + 1; i < numBuckets && len(nodes) < d.k; i++ {
+		gather(d.Buckets[i])
+	}
+
+	sortByDistance(nodes, key)
+	if len(nodes) > d.k {
+		nodes = nodes[:d.k]
+	}
+
+	return nodes
+}
+
+// Sends message to the node, which over a transport authenticating
+// its peers must prove that it owns the ID of the node, if we know it
+func (d *Dht) sendMessageToNode(msg *Message, node *Node) error {
+	return d.sendMessageTo(msg, node.AddressString(), node.Id)
 }
 
-// Sends message to node receiver
+// Sends message to whichever node is at the address
 func (d *Dht) sendMessage(msg *Message, addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	return d.sendMessageTo(msg, addr, nil)
+}
+
+// Sends message to the node at the address. If the transport
+// authenticates its peers and the ID is given, the message is only
+// sent if the peer owns the ID, so that no other node listening at
+// the address can read it.
+func (d *Dht) sendMessageTo(msg *Message, addr string, id []byte) error {
+	conn, err := d.Transport.Dial(addr)
 	if err != nil {
 		writeLog("Error sending back response to message: %d, error: %v\n", msg.MsgId, err)
 		return err
 	}
 
-	encoder := gob.NewEncoder(conn)
-	err = encoder.Encode(*msg)
+	if peer, ok := conn.(authenticatedConn); ok && id != nil {
+		key, err := peer.PeerKey()
+		if err == nil && !bytes.Equal(nodeIdFor(key), id) {
+			err = fmt.Errorf("peer at %s does not own node ID %v", addr, id)
+		}
+		if err != nil {
+			writeLog("Not sending message %v, error: %s\n", msg.MsgId, err)
+			conn.Close()
+			return err
+		}
+	}
+
+	// Every message is stamped with our protocol version and
+	// capabilities and signed, leaving the message of the caller
+	// untouched
+	stamped := *msg
+	stamped.Version = d.Node.Version
+	stamped.Capabilities = d.Node.Capabilities
+	d.signMessage(&stamped)
+	err = d.codec.Encode(conn, &stamped)
 	if err != nil {
 		writeLog("Error encoding response to message: %d, error: %v\n", msg.MsgId, err)
+		conn.Close()
 		return err
 	}
 
-	conn.Close()
-	return nil
+	// Closing the connection sends the message for some transports
+	return conn.Close()
 }
 
 // Join a Kademlia network, by pinging an existing node, and further
-// acquiring a list of nodes in the network to seed the k buckets
-func (d *Dht) join(IP net.IP, Port int) error {
+// acquiring a list of nodes in the network to seed the k buckets. The
+// buddy node is inserted into our k-buckets once it responds, after
+// which we look up our own ID, populating the buckets with our closest
+// neighbors. Then every bucket further away than the closest neighbor
+// is refreshed with a lookup for a random ID in its range. Returns the
+// number of contacts learned by joining.
+func (d *Dht) join(IP net.IP, Port int) (int, error) {
 	writeLog("Joining the kademlia network with buddy node %s:%d", IP, Port)
-	pingMsg := &Message{
-		Type:   PingMsg,
-		MsgId:  GenerateMsgId(),
-		Sender: d.Node,
-		Pong:   false,
+	before := d.nodeCount()
+
+	// We only know the address of the buddy node, and learn its
+	// ID from the pong, which places it in the k-buckets
+	buddy := &Node{Addr: IP, Port: Port}
+	resp, err := d.call(d.formPingMsg(false), buddy, d.rpcTimeout)
+	if err != nil {
+		return 0, err
+	}
+
+	// Every node of the network requires the same puzzle difficulty,
+	// so a buddy requiring another is in a network we cannot join
+	if resp.Sender.Difficulty != d.Node.Difficulty {
+		return 0, fmt.Errorf("buddy node requires puzzle difficulty %s, rather than %s", resp.Sender.Difficulty, d.Node.Difficulty)
 	}
-	return d.sendMessageHost(pingMsg, IP, Port)
+
+	d.LookupNode(d.Node.Id)
+
+	closest := d.getKNearestNodes(d.Node.Id, nil)
+	if len(closest) > 0 {
+		for i := d.getHighestAllowableBucketIndex(closest[0].Id) + 1; i < numBuckets; i++ {
+			d.LookupNode(d.randomIdInBucket(i))
+		}
+	}
+
+	return d.nodeCount() - before, nil
 }
 
 func (d *Dht) handleConn(conn net.Conn) {
@@ -230,30 +578,99 @@ func (d *Dht) handleConn(conn net.Conn) {
 	defer func() {
 		writeLog("Closing connection")
 		conn.Close()
-		d.ConnClosed <- struct{}{}
+
+		// Signal without blocking, so handlers do not hang
+		// when nobody is waiting on the connection closing
+		select {
+		case d.ConnClosed <- struct{}{}:
+		default:
+		}
 	}()
 
 	// Decode the client message to well-defined message type
-	decoder := gob.NewDecoder(conn)
-	msg := Message{}
-	err := decoder.Decode(&msg)
-	if err != nil && err != io.EOF {
-		writeLog("Error decoding message %s", err)
+	msg, err := d.codec.Decode(conn)
+	if err != nil {
+		if err != io.EOF {
+			writeLog("Error decoding message %s", err)
+		}
+		return
+	}
+
+	if msg.Sender == nil {
+		writeLog("Dropping message %v without sender", msg.MsgId)
+		return
+	}
+
+	if !compatibleVersion(msg.Version) {
+		writeLog("Dropping message %v of incompatible protocol version %d", msg.MsgId, msg.Version)
+		return
+	}
+
+	if err := verifyMessage(msg); err != nil {
+		writeLog("Dropping message %v from %s, error: %s", msg.MsgId, msg.Sender.AddressString(), err)
+		return
+	}
+
+	// Over an authenticated transport, the sender must be the owner of
+	// the key the connection was authenticated with
+	if peer, ok := conn.(authenticatedConn); ok {
+		if key, err := peer.PeerKey(); err != nil || !bytes.Equal(key, msg.Sender.PublicKey) {
+			writeLog("Dropping message %v from %s, which is not the peer of the connection", msg.MsgId, msg.Sender.AddressString())
+			return
+		}
+	}
+
+	// While leaving we stop serving requests, but still need the
+	// responses to the requests made while handing off our keys
+	if !msg.Response && d.isLeaving() {
+		writeLog("Dropping message %v while leaving", msg.MsgId)
+		return
+	}
+
+	// Responses are routed to the request waiting on them,
+	// rather than to the handler for the message type
+	if msg.Response {
+		d.handleResponse(msg)
 		return
 	}
 
-	// Route message to appropriate handler
+	// Requests for a key are placed by the key in our buckets, which
+	// takes a key of the size of an ID
+	if msg.Type == FindValueMsg || msg.Type == StoreMsg || msg.Type == FindNodeMsg {
+		if len(msg.Key) != keysize {
+			writeLog("Dropping message %v with key of %d bytes", msg.MsgId, len(msg.Key))
+			return
+		}
+	}
+
+	// Route message to appropriate handler, requests which
+	// expect a response have it sent back to the sender
+	var resp *Message
 	switch msg.Type {
 	case PingMsg:
-		d.Ping(&msg)
+		resp, err = d.Ping(msg)
 	case FindValueMsg:
-		d.FindValue(&msg)
+		resp, err = d.FindValue(msg)
 	case StoreMsg:
-		d.Store(&msg)
+		resp, err = d.Store(msg)
 	case FindNodeMsg:
-		d.FindNode(&msg)
+		resp, err = d.FindNode(msg)
+	case LeaveMsg:
+		resp, err = d.NodeLeaving(msg)
 	default:
-		writeErr("Unrecognized message type %d", msg.Type)
+		// Nodes of newer protocol versions may send types we do not know
+		writeLog("Dropping message %v of unknown type %d", msg.MsgId, msg.Type)
+		return
+	}
+
+	if err != nil {
+		writeLog("Error handling message %v, error: %s", msg.MsgId, err)
+		return
+	}
+
+	if resp != nil {
+		resp.Response = true
+		d.sendMessageToNode(resp, msg.Sender)
 	}
 }
 
@@ -269,21 +686,96 @@ func (d *Dht) entry() {
 	}
 }
 
+// Listen on the port of this node, falling back to another
+// random port if the chosen one is already in use
 func (d *Dht) initListener() {
 	var err error
-	d.Listener, err = net.Listen("tcp", fmt.Sprintf(":%d", d.Node.Port))
-	if err != nil {
+	for attempt := 0; attempt < maxListenAttempts; attempt++ {
+		d.Listener, err = d.Transport.Listen(d.Node.Port)
+		if err == nil {
+			return
+		}
+
 		writeLog("Error listening on port %d\n", d.Node.Port)
+		d.Node.Port = randomPort()
+	}
+}
+
+// Shut down the dht, stopping its background loops and closing its
+// listener, which ends the entry loop serving connections
+func (d *Dht) Close() error {
+	d.stopLoops()
+	return d.Listener.Close()
+}
+
+// Option configuring a dht when it is constructed
+type DhtOption func(*Dht)
+
+// Listen on the given port, rather than a random port
+func WithPort(port int) DhtOption {
+	return func(d *Dht) {
+		d.Node.Port = port
+	}
+}
+
+// Keep up to k nodes in each bucket, and locate and store each pair
+// on the k closest nodes, rather than the default maxNodesInBucket
+func WithBucketSize(k int) DhtOption {
+	return func(d *Dht) {
+		d.k = k
+	}
+}
+
+// Send up to the given number of lookup requests in parallel, rather
+// than the default alpha
+func WithAlpha(parallelism int) DhtOption {
+	return func(d *Dht) {
+		d.alpha = parallelism
 	}
 }
 
-func NewDht() *Dht {
+func NewDht(opts ...DhtOption) *Dht {
+	node, privateKey := NewIdentity()
 	dht := &Dht{
-		Done:       make(chan struct{}),
-		ConnClosed: make(chan struct{}),
-		Data:       NewKVStore(),
-		Node:       NewNode(),
-		Buckets:    make([][]*Node, numBuckets),
+		Done:         make(chan struct{}),
+		ConnClosed:   make(chan struct{}, connClosedBacklog),
+		Data:         NewKVStore(),
+		Node:         node,
+		Buckets:      make([][]*Node, numBuckets),
+		Replacements: make([][]*Node, numBuckets),
+		pending:      newPendingRequests(),
+		evicting:     make(map[int]bool),
+		lastLookup:   make([]time.Time, numBuckets),
+		quit:         make(chan struct{}),
+		Transport:    TCPTransport{},
+		rpcTimeout:   tRpcTimeout,
+		k:            maxNodesInBucket,
+		alpha:        alpha,
+		paths:        1,
+		clock:        systemClock{},
+		codec:        BinaryCodec{},
+		privateKey:   privateKey,
+	}
+
+	for _, opt := range opts {
+		opt(dht)
+	}
+	dht.solvePuzzles()
+
+	// Connections are authenticated with our final key pair, so the
+	// transport is wrapped once the puzzles are solved
+	if dht.encrypted {
+		transport, err := NewTLSTransport(dht.Transport, dht.privateKey)
+		if err != nil {
+			panic(fmt.Sprintf("setting up TLS transport: %s", err))
+		}
+		dht.Transport = transport
+	}
+
+	// Buckets are considered freshly looked up when we start,
+	// joining the network takes care of populating them
+	for i := range dht.lastLookup {
+		dht.lastLookup[i] = dht.clock.Now()
 	}
 
 	// Set up listener and proceed to entry, which is
@@ -301,10 +793,115 @@ func main() {
 	joinIP := flag.String("joinIP", "", "IP address of joining server")
 	joinPort := flag.Int("joinPort", -1, "Port number of joining server")
 	loggingEnabled := flag.Bool("loggingEnabled", false, "Enable logging")
+	transportName := flag.String("transport", "tcp", "Transport used to reach other servers, tcp or udp")
+	codecName := flag.String("codec", "binary", "Codec messages are encoded with, binary or gob")
+	puzzleStatic := flag.Uint("puzzleStatic", 0, "Difficulty of the static crypto puzzle, the same across the network")
+	puzzleDynamic := flag.Uint("puzzleDynamic", 0, "Difficulty of the dynamic crypto puzzle, the same across the network")
+	disjointPaths := flag.Int("paths", 1, "Number of disjoint paths each lookup is split over")
+	encrypted := flag.Bool("tls", false, "Encrypt connections to other servers with TLS, over the tcp transport")
+
+	// These flags run a lookup simulation over a simulated network in
+	// place of a server, reporting on lookups for each combination of
+	// the given bucket sizes, lookup parallelism and disjoint paths. The
+	// simulation runs in real time, with every node serving requests on
+	// its own goroutines and signing and verifying each message, so its
+	// cost grows faster than the number of nodes.
+	simulate := flag.Bool("simulate", false, "Run a lookup simulation instead of a server")
+	simNodes := flag.Int("simNodes", 100, "Number of nodes in the simulated network, "+
+		"a simulation takes seconds on one core with 100 nodes and over half a minute with 300")
+	simLookups := flag.Int("simLookups", 100, "Number of lookups of each kind in the simulation")
+	simK := flag.String("simK", strconv.Itoa(maxNodesInBucket), "Comma separated bucket sizes to simulate")
+	simAlpha := flag.String("simAlpha", strconv.Itoa(alpha), "Comma separated lookup parallelism to simulate")
+	simPaths := flag.String("simPaths", "1", "Comma separated numbers of disjoint lookup paths to simulate")
+	simAdversarial := flag.Float64("simAdversarial", 0, "Fraction of simulated nodes which collude to mislead lookups")
+	simSeed := flag.Int64("simSeed", 1, "Seed of the simulation")
+
+	// These flags run a churn scenario over simulated time in place of
+	// a lookup simulation, using the bucket sizes, lookup parallelism and
+	// seed given to the lookup simulation. Simulated time is free, but
+	// every message is still signed and verified, and each node refreshes
+	// its buckets and replicates its pairs every hour, so the cost of a
+	// scenario grows faster than the number of nodes.
+	churn := flag.Bool("churn", false, "Run a churn scenario instead of a server")
+	churnNodes := flag.Int("churnNodes", 8, "Number of nodes at the start of the churn scenario, "+
+		"a 48h scenario takes seconds on one core with 8 nodes and over half a minute with 20")
+	churnKeys := flag.Int("churnKeys", 10, "Number of pairs stored at the start of the churn scenario")
+	churnDuration := flag.Duration("churnDuration", 48*time.Hour, "Simulated time the churn scenario runs for")
+	churnJoinRate := flag.Float64("churnJoinRate", 2, "Nodes joining per simulated hour")
+	churnKillRate := flag.Float64("churnKillRate", 2, "Nodes killed per simulated hour")
+	churnProbe := flag.Duration("churnProbe", 4*time.Hour, "Simulated time between measurements of retrievable pairs")
 	flag.Parse()
 
 	configs.LoggingEnabled = *loggingEnabled
-	dht := NewDht()
+	if *simulate || *churn {
+		ks, err := parseIntList(*simK)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		alphas, err := parseIntList(*simAlpha)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		paths, err := parseIntList(*simPaths)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *churn {
+			err = runChurnScenarios(ChurnConfig{
+				Nodes:    *churnNodes,
+				Keys:     *churnKeys,
+				Duration: *churnDuration,
+				JoinRate: *churnJoinRate,
+				KillRate: *churnKillRate,
+				Probe:    *churnProbe,
+				Seed:     *simSeed,
+			}, ks, alphas)
+		} else {
+			err = runSimulations(SimulationConfig{
+				Nodes:       *simNodes,
+				Lookups:     *simLookups,
+				Adversarial: *simAdversarial,
+				Seed:        *simSeed,
+			}, ks, alphas, paths)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	transport, err := transportByName(*transportName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	codec, err := codecByName(*codecName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *puzzleStatic > maxPuzzleDifficulty || *puzzleDynamic > maxPuzzleDifficulty {
+		log.Fatalf("Puzzle difficulty must be at most %d bits", maxPuzzleDifficulty)
+	}
+	difficulty := PuzzleDifficulty{Static: uint8(*puzzleStatic), Dynamic: uint8(*puzzleDynamic)}
+
+	if *disjointPaths < 1 {
+		log.Fatalf("Lookups need at least 1 path, got %d", *disjointPaths)
+	}
+
+	opts := []DhtOption{WithTransport(transport), WithCodec(codec), WithPuzzleDifficulty(difficulty), WithDisjointPaths(*disjointPaths)}
+	if *encrypted {
+		if *transportName != "tcp" {
+			log.Fatalf("TLS needs the tcp transport, got %s", *transportName)
+		}
+		opts = append(opts, WithTLS())
+	}
+
+	dht := NewDht(opts...)
 
 	go func() {
 		defer func() {
@@ -318,16 +915,33 @@ func main() {
 	writeLog("DHT server started at %s\n", dht.Listener.Addr().String())
 
 	if *joinIP != "" && *joinPort != -1 {
-		err := dht.join(net.ParseIP(*joinIP), *joinPort)
+		learned, err := dht.join(net.ParseIP(*joinIP), *joinPort)
 
 		if err != nil {
 			writeLog("Fatal error attempting to join network %s", err)
+		} else {
+			writeLog("Joined network with buddy node %s:%d, learned %d contacts", *joinIP, *joinPort, learned)
 		}
 	}
 
-	// TODO key clean up thread
+	dht.startRefresh()
+	dht.startSweeper()
+	dht.startReplication()
+	dht.startRepublish()
 
-	// TODO key republish-replicate thread
+	// Leave the network on interrupt, handing off our keys, which
+	// closes the listener and so signals the done channel
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		ctx, cancel := context.WithTimeout(context.Background(), tLeave)
+		defer cancel()
+
+		if err := dht.Leave(ctx); err != nil {
+			writeLog("Error leaving network %s", err)
+		}
+	}()
 
 	// rpc receive queue thread
 
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"math/rand"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestAddNodesUpToMaxInBucket(t *testing.T) {
@@ -10,7 +15,8 @@ func TestAddNodesUpToMaxInBucket(t *testing.T) {
 
 	for i := 0; i < maxNodesInBucket; i++ {
 		nodei := NewNode()
-		nodei.dummyId() // set same ID for all nodes to ensure placed in same bucket
+		nodei.dummyId()       // set same ID for all nodes to ensure placed in same bucket
+		nodei.Port = 4000 + i // set distinct ports, so nodes are not treated as the same contact
 		table1.addToKBucket(nodei)
 	}
 
@@ -22,6 +28,7 @@ func TestAddNodesUpToMaxInBucket(t *testing.T) {
 	// ensure we do not exceed themax nodes in the bucket
 	nodePastMax := NewNode()
 	nodePastMax.dummyId()
+	nodePastMax.Port = 4000 + maxNodesInBucket
 	table1.addToKBucket(nodePastMax)
 
 	if count := table1.nodeCount(); count != maxNodesInBucket {
@@ -35,10 +42,13 @@ func TestAddNodesToKBucketBasic(t *testing.T) {
 
 	node1 := NewNode()
 	node1.dummyId()
+	node1.Port = 4001
 	node2 := NewNode()
 	node2.dummyId()
+	node2.Port = 4002
 	node3 := NewNode()
 	node3.dummyId()
+	node3.Port = 4003
 
 	table1.addToKBucket(node1)
 	table1.addToKBucket(node2)
@@ -81,3 +91,397 @@ func TestGetHighestAllowableBucketIndex(t *testing.T) {
 		}
 	}
 }
+
+// Generate a random ID which shares the first prefixBits bits with base
+func randomIdWithPrefix(base []byte, prefixBits int) []byte {
+	id := make([]byte, keysize)
+	rand.Read(id)
+	for i := 0; i < prefixBits; i++ {
+		mask := byte(1 << (7 - i%8))
+		id[i/8] = id[i/8]&^mask | base[i/8]&mask
+	}
+
+	return id
+}
+
+// Brute force reference for the k nearest nodes, sorting every
+// node in the k buckets by distance to the key
+func bruteForceKNearestNodes(d *Dht, key []byte, exclude *Node) []*Node {
+	var nodes []*Node
+	for _, bucket := range d.Buckets {
+		for _, node := range bucket {
+			if exclude == nil || !bytes.Equal(node.Id, exclude.Id) {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	sortByDistance(nodes, key)
+	if len(nodes) > maxNodesInBucket {
+		nodes = nodes[:maxNodesInBucket]
+	}
+
+	return nodes
+}
+
+// Test the k nearest nodes gathered outward from the bucket of the
+// key against a brute force reference, over random node IDs spread
+// across the buckets, and keys both near and far from this node
+func TestGetKNearestNodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		numNodes  int
+		keyPrefix int
+		exclude   bool
+	}{
+		{"empty table", 0, 0, false},
+		{"fewer than k nodes", 5, 0, false},
+		{"exactly k nodes", maxNodesInBucket, 0, false},
+		{"many nodes, far key", 500, 0, false},
+		{"many nodes, near key", 500, 12, false},
+		{"many nodes, own ID", 500, keysize * 8, false},
+		{"many nodes, excluding requester", 500, 4, true},
+		{"few nodes, excluding requester", 3, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := NewDht()
+
+			// Spread nodes across buckets by varying the length of
+			// the prefix they share with this node
+			for i := 0; i < test.numNodes; i++ {
+				node := NewNode()
+				node.Id = randomIdWithPrefix(table.Node.Id, rand.Intn(24))
+				table.addToKBucket(node)
+			}
+
+			// Closing waits for the evictions started by full buckets,
+			// so the buckets no longer change while being compared
+			table.Close()
+
+			key := randomIdWithPrefix(table.Node.Id, test.keyPrefix)
+
+			var exclude *Node
+			if test.exclude {
+				exclude = bruteForceKNearestNodes(table, key, nil)[0]
+			}
+
+			expected := bruteForceKNearestNodes(table, key, exclude)
+			result := table.getKNearestNodes(key, exclude)
+			if len(result) != len(expected) {
+				t.Fatalf("Expected %d nearest nodes, got %d", len(expected), len(result))
+			}
+
+			for i := range expected {
+				if !bytes.Equal(result[i].Id, expected[i].Id) {
+					t.Errorf("Nearest node %d should be %v, got %v", i, expected[i].Id, result[i].Id)
+				}
+			}
+
+			if exclude != nil {
+				for _, node := range result {
+					if bytes.Equal(node.Id, exclude.Id) {
+						t.Errorf("Excluded node %v should not be returned", exclude.Id)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Random IDs generated for each bucket should fall into that bucket
+func TestRandomIdInBucket(t *testing.T) {
+	table := NewDht()
+	defer table.Listener.Close()
+
+	for i := 0; i < numBuckets; i++ {
+		id := table.randomIdInBucket(i)
+		if result := table.getHighestAllowableBucketIndex(id); result != i {
+			t.Errorf("Random ID for bucket %d should fall into bucket %d, got bucket %d", i, i, result)
+		}
+	}
+}
+
+// Get a port which no node is listening on
+func unusedPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening, error: %s", err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Create a node in the bucket with the highest index for a table
+// with the dummy ID, which no node is listening for
+func unreachableNode(port int) *Node {
+	node := NewNode()
+	node.Id[0] |= 0x80
+	node.Port = port
+	return node
+}
+
+// Generate a private key for a node whose ID has the given most
+// significant bit, either 0 or 0x80
+func keyWithTopBit(bit byte) ed25519.PrivateKey {
+	for {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err == nil && nodeIdFor(publicKey)[0]&0x80 == bit {
+			return privateKey
+		}
+	}
+}
+
+// Check whether the bucket contains the node, and is still full
+func bucketContains(table *Dht, bucketIndex int, other *Node) bool {
+	table.mtx.Lock()
+	defer table.mtx.Unlock()
+	for _, node := range table.Buckets[bucketIndex] {
+		if node.equals(other) {
+			return len(table.Buckets[bucketIndex]) == maxNodesInBucket
+		}
+	}
+
+	return false
+}
+
+// When the least recently seen node in a full bucket responds to a
+// ping, it should be kept in favour of the new node
+func TestFullBucketKeepsResponsiveNode(t *testing.T) {
+	// Nodes sign their messages, so their IDs cannot be rewritten,
+	// and are instead derived from keys placing them apart
+	network := NewSimNetwork(1)
+	table := serveDht(network.NewDht(WithPrivateKey(keyWithTopBit(0))))
+	live := serveDht(network.NewDht(WithPrivateKey(keyWithTopBit(0x80))))
+	defer stopDhts([]*Dht{table, live})
+
+	// The live node is added first, so is least recently seen
+	port := unusedPort(t)
+	table.addToKBucket(live.Node)
+	for i := 1; i < maxNodesInBucket; i++ {
+		table.addToKBucket(unreachableNode(port))
+	}
+
+	newcomer := unreachableNode(port)
+	table.addToKBucket(newcomer)
+
+	// The pong from the live node moves it to the front of the bucket
+	waitFor(t, time.Second, func() bool {
+		table.mtx.Lock()
+		defer table.mtx.Unlock()
+		return !table.evicting[numBuckets-1] && table.Buckets[numBuckets-1][0].equals(live.Node)
+	})
+
+	if bucketContains(table, numBuckets-1, newcomer) {
+		t.Errorf("New node should be discarded when least recently seen node responds")
+	}
+
+	if count := table.nodeCount(); count != maxNodesInBucket {
+		t.Errorf("Node count should be %d, but got %d", maxNodesInBucket, count)
+	}
+}
+
+// When the least recently seen node in a full bucket fails to respond
+// to a ping, it should be evicted in favour of the new node
+func TestFullBucketEvictsUnresponsiveNode(t *testing.T) {
+	dhts, _ := startSimDhts(1)
+	defer stopDhts(dhts)
+	table := dhts[0]
+	table.Node.dummyId()
+
+	port := unusedPort(t)
+	leastRecent := unreachableNode(port)
+	table.addToKBucket(leastRecent)
+	for i := 1; i < maxNodesInBucket; i++ {
+		table.addToKBucket(unreachableNode(port))
+	}
+
+	newcomer := unreachableNode(port)
+	table.addToKBucket(newcomer)
+
+	waitFor(t, time.Second, func() bool { return bucketContains(table, numBuckets-1, newcomer) })
+
+	if bucketContains(table, numBuckets-1, leastRecent) {
+		t.Errorf("Unresponsive least recently seen node should be evicted")
+	}
+
+	if front := table.Buckets[numBuckets-1][0]; !front.equals(newcomer) {
+		t.Errorf("New node should be at the front of the bucket, got %v", front.Id)
+	}
+}
+
+// Nodes seen while their bucket is full should be kept in the
+// replacement cache, up to the maximum size of the cache
+func TestReplacementCacheForFullBucket(t *testing.T) {
+	network := NewSimNetwork(1)
+	table := serveDht(network.NewDht(WithPrivateKey(keyWithTopBit(0))))
+	defer stopDhts([]*Dht{table})
+
+	// Every contact in the bucket is live, so each one pinged before
+	// eviction responds, and no candidate is promoted
+	for i := 0; i < maxNodesInBucket; i++ {
+		live := serveDht(network.NewDht(WithPrivateKey(keyWithTopBit(0x80))))
+		defer stopDhts([]*Dht{live})
+		table.addToKBucket(live.Node)
+	}
+
+	port := unusedPort(t)
+	for i := 0; i < 3; i++ {
+		table.addToKBucket(unreachableNode(port))
+	}
+
+	stats := table.Stats()
+	if stats.Contacts != maxNodesInBucket || stats.Replacements != 3 {
+		t.Errorf("Expected %d contacts and 3 replacements, got %+v", maxNodesInBucket, stats)
+	}
+
+	if bucket := stats.Buckets[numBuckets-1]; bucket.Contacts != maxNodesInBucket || bucket.Replacements != 3 {
+		t.Errorf("Expected %d contacts and 3 replacements in bucket, got %+v", maxNodesInBucket, bucket)
+	}
+
+	// Seeing a candidate again should not add it to the cache twice
+	candidate := unreachableNode(port)
+	table.addToKBucket(candidate)
+	table.addToKBucket(candidate)
+	if stats := table.Stats(); stats.Replacements != 4 {
+		t.Errorf("Expected 4 replacements, got %d", stats.Replacements)
+	}
+
+	for i := 0; i < maxReplacementsInBucket; i++ {
+		table.addToKBucket(unreachableNode(port))
+	}
+
+	if stats := table.Stats(); stats.Replacements != maxReplacementsInBucket {
+		t.Errorf("Expected %d replacements, got %d", maxReplacementsInBucket, stats.Replacements)
+	}
+
+	if stats := table.Stats(); stats.Contacts != maxNodesInBucket {
+		t.Errorf("No candidate should be promoted while contacts respond, got %d contacts", stats.Contacts)
+	}
+}
+
+// When an unresponsive node is evicted from a full bucket, the most
+// recently seen replacement candidate should be promoted in its place
+func TestReplacementPromotedOnEviction(t *testing.T) {
+	network := NewSimNetwork(1)
+	table := serveDht(network.NewDht(WithPrivateKey(keyWithTopBit(0)), WithRPCTimeout(200*time.Millisecond)))
+	silent := serveDht(network.NewDht(WithPrivateKey(keyWithTopBit(0x80))))
+	defer stopDhts([]*Dht{table, silent})
+
+	// The least recently seen node is cut off from us, so its ping
+	// times out, and both candidates are cached in the meantime
+	network.Partition(table.Node, silent.Node)
+	leastRecent := silent.Node
+	port := unusedPort(t)
+	table.addToKBucket(leastRecent)
+	for i := 1; i < maxNodesInBucket; i++ {
+		table.addToKBucket(unreachableNode(port))
+	}
+
+	older, newer := unreachableNode(port), unreachableNode(port)
+	table.addToKBucket(older)
+	table.addToKBucket(newer)
+
+	waitFor(t, time.Second, func() bool {
+		table.mtx.Lock()
+		defer table.mtx.Unlock()
+		return table.Buckets[numBuckets-1][0].equals(newer)
+	})
+
+	if bucketContains(table, numBuckets-1, leastRecent) {
+		t.Errorf("Unresponsive least recently seen node should be evicted")
+	}
+
+	if !bucketContains(table, numBuckets-1, newer) {
+		t.Errorf("Most recently seen replacement should be promoted into the bucket")
+	}
+
+	if stats := table.Stats(); stats.Replacements != 1 || stats.Contacts != maxNodesInBucket {
+		t.Errorf("Expected %d contacts and 1 replacement, got %+v", maxNodesInBucket, stats)
+	}
+}
+
+// Cached copies should live for half as long with each node
+// between the caching node and the k closest nodes to the key
+func TestCachedExpiration(t *testing.T) {
+	tests := []struct {
+		closer   int
+		expected time.Duration
+	}{
+		{maxNodesInBucket, tExpire / 2},
+		{maxNodesInBucket + 1, tExpire / 4},
+		{maxNodesInBucket + 3, tExpire / 16},
+		{maxNodesInBucket + 100, tMaintenance},
+	}
+
+	for _, test := range tests {
+		if result := cachedExpiration(test.closer, maxNodesInBucket); result != test.expected {
+			t.Errorf("Expiration with %d closer nodes should be %s, got %s", test.closer, test.expected, result)
+		}
+	}
+}
+
+// Cached copies stored at a node within the k closest to the key
+// should keep the requested expiration, and beyond them should expire
+// sooner the further the node is from the key. Copies which are not
+// cached always keep the requested expiration.
+func TestStoreScalesExpirationByDistance(t *testing.T) {
+	tests := []struct {
+		name     string
+		closer   int
+		cached   bool
+		expected time.Duration
+	}{
+		{"no closer nodes", 0, true, tExpire},
+		{"within k closest", maxNodesInBucket - 1, true, tExpire},
+		{"just beyond k closest", maxNodesInBucket, true, tExpire / 2},
+		{"further beyond k closest", maxNodesInBucket + 2, true, tExpire / 8},
+		{"not cached beyond k closest", maxNodesInBucket + 2, false, tExpire},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := NewDht()
+			defer table.Close()
+
+			// Every node is closer than this node to the key with all
+			// bits of this node's ID flipped, and no node is closer to
+			// the key which is this node's ID
+			key := make([]byte, keysize)
+			for i := range key {
+				key[i] = ^table.Node.Id[i]
+			}
+			if test.closer == 0 {
+				key = table.Node.Id
+			}
+
+			// The sender of the store is also placed in the buckets
+			sender := NewNode()
+			sender.Id = table.randomIdInBucket(numBuckets - 1)
+			for i := 1; i < test.closer; i++ {
+				node := NewNode()
+				node.Id = table.randomIdInBucket(numBuckets - 1 - i/maxNodesInBucket)
+				table.addToKBucket(node)
+			}
+
+			req := table.formStoreKeyMsg(key, []byte("value"))
+			req.Sender = sender
+			req.Cached = test.cached
+			if _, err := table.Store(req); err != nil {
+				t.Fatalf("Error serving store, error: %s", err)
+			}
+
+			value, err := table.Data.GetValue(key)
+			if err != nil {
+				t.Fatalf("Pair should be stored, error: %s", err)
+			}
+
+			expected := time.Now().Add(test.expected)
+			if diff := value.ExpirationTime.Sub(expected); diff > time.Second || diff < -time.Second {
+				t.Errorf("Pair should expire at %s, expires at %s", expected, value.ExpirationTime)
+			}
+		})
+	}
+}
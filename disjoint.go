@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sync"
+)
+
+// Split each lookup over the given number of disjoint paths, rather
+// than a single path, so that a lookup is only misled if most paths
+// are. No contact is queried on more than one path, and results are
+// only returned if a majority of the paths agree.
+func WithDisjointPaths(paths int) DhtOption {
+	return func(d *Dht) {
+		d.paths = paths
+	}
+}
+
+// Contacts claimed by the paths of a disjoint lookup, each of which
+// is only queried by the path which claimed it first, and the claimed
+// contacts which failed to respond
+type pathClaims struct {
+	mtx     sync.Mutex
+	claimed map[string]bool
+	failed  map[string]bool
+}
+
+func newPathClaims() *pathClaims {
+	return &pathClaims{claimed: make(map[string]bool), failed: make(map[string]bool)}
+}
+
+// Claim the contact for a path, returning false if another path
+// already claimed it
+func (c *pathClaims) claim(node *Node) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.claimed[string(node.Id)] {
+		return false
+	}
+
+	c.claimed[string(node.Id)] = true
+	return true
+}
+
+// Record that the contact failed to respond to the path claiming it
+func (c *pathClaims) fail(node *Node) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.failed[string(node.Id)] = true
+}
+
+// Get the contacts which have not failed to respond to any path
+func (c *pathClaims) responsive(nodes []*Node) []*Node {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var live []*Node
+	for _, node := range nodes {
+		if !c.failed[string(node.Id)] {
+			live = append(live, node)
+		}
+	}
+
+	return live
+}
+
+// Perform an iterative lookup over disjoint paths, as proposed by
+// S/Kademlia. Our closest contacts are dealt out among the paths in
+// turn, and each path then runs as a lookup of its own, in parallel
+// with the others. With fewer contacts than paths, there is one path
+// for each contact. Paths share which contacts they have claimed, and
+// a path leaves any contact claimed by another path to it, so that
+// one malicious contact can mislead at most one path.
+func (d *Dht) disjointLookup(target []byte, findValue bool) *lookupResult {
+	claims := newPathClaims()
+	contacts := d.getKNearestNodes(target, nil)
+	count := d.paths
+	if len(contacts) < count {
+		count = len(contacts)
+	}
+	if count == 0 {
+		count = 1
+	}
+
+	lists := make([]*shortlist, count)
+	for i := range lists {
+		lists[i] = newShortlist(target, d.Node.Id, d.k)
+		lists[i].claims = claims
+	}
+
+	for i, contact := range contacts {
+		lists[i%len(lists)].add([]*Node{contact})
+	}
+
+	paths := make([]*lookupResult, len(lists))
+	var wg sync.WaitGroup
+	for i, list := range lists {
+		wg.Add(1)
+		go func(i int, list *shortlist) {
+			defer wg.Done()
+			paths[i] = d.lookupPath(list, target, findValue)
+		}(i, list)
+	}
+	wg.Wait()
+
+	return mergePaths(paths, claims, target, d.k)
+}
+
+// Combine the results of the paths of a disjoint lookup, returning
+// them only if the paths agree, which takes a strict majority of the
+// paths reaching the same answer. For value lookups, the answer of a
+// path is the value it found, if any. If no path found a value, the
+// answer of a path is its closest responsive contact, and the k
+// closest contacts located by the agreeing paths are returned. Paths
+// without an answer count against the majority, as a path led astray
+// may equally have been led to nothing. Hops counts the rounds of
+// the longest path.
+func mergePaths(paths []*lookupResult, claims *pathClaims, target []byte, k int) *lookupResult {
+	result := &lookupResult{}
+	foundValue := false
+	for _, path := range paths {
+		result.messages += path.messages
+		result.contacted = append(result.contacted, path.contacted...)
+		if path.hops > result.hops {
+			result.hops = path.hops
+		}
+		foundValue = foundValue || path.value != nil
+	}
+
+	answers := make([]string, len(paths))
+	for i, path := range paths {
+		path.closest = claims.responsive(path.closest)
+		if foundValue && path.value != nil {
+			answers[i] = string(path.value)
+		} else if !foundValue && len(path.closest) > 0 {
+			answers[i] = string(path.closest[0].Id)
+		}
+	}
+
+	agreed, ok := majority(answers)
+	if !ok {
+		// Without any contacts there is nothing to disagree on
+		if !foundValue && agreed == "" {
+			return result
+		}
+		return disagreed(result)
+	}
+
+	seen := make(map[string]bool)
+	for i, path := range paths {
+		if answers[i] != agreed {
+			continue
+		}
+
+		result.value = path.value
+		result.missing = append(result.missing, path.missing...)
+		for _, node := range path.closest {
+			if !seen[string(node.Id)] {
+				seen[string(node.Id)] = true
+				result.closest = append(result.closest, node)
+			}
+		}
+	}
+
+	sortByDistance(result.missing, target)
+	sortByDistance(result.closest, target)
+	if len(result.closest) > k {
+		result.closest = result.closest[:k]
+	}
+
+	return result
+}
+
+// Get the answer given by a strict majority of the answers, where
+// an empty answer is no answer, and whether there is such a majority.
+// Without a majority, the most common answer is returned.
+func majority(answers []string) (string, bool) {
+	counts := make(map[string]int)
+	best := ""
+	for _, answer := range answers {
+		if answer == "" {
+			continue
+		}
+
+		counts[answer]++
+		if counts[answer] > counts[best] {
+			best = answer
+		}
+	}
+
+	return best, counts[best]*2 > len(answers)
+}
+
+// Drop the results of a lookup whose paths disagreed, keeping the
+// count of hops and messages it took
+func disagreed(result *lookupResult) *lookupResult {
+	result.closest, result.value, result.missing = nil, nil, nil
+	result.disagreed = true
+	return result
+}
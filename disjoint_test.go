@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// In an honest network, a disjoint lookup should locate the same
+// closest nodes as a lookup over a single path, without querying any
+// node on more than one path
+func TestDisjointLookupFindsClosestNodes(t *testing.T) {
+	dhts := joinDhts(t, 12)
+	defer stopDhts(dhts)
+
+	source := dhts[len(dhts)-1]
+	target := Hash([]byte("disjoint target"))
+	expected := source.LookupNode(target)
+
+	source.paths = 3
+	result := source.iterativeLookup(target, false)
+	if result.disagreed || len(result.closest) != len(expected) {
+		t.Fatalf("Disjoint lookup should return %d nodes, got %d, disagreed %t", len(expected), len(result.closest), result.disagreed)
+	}
+
+	for i := range expected {
+		if !bytes.Equal(result.closest[i].Id, expected[i].Id) {
+			t.Errorf("Node %d of disjoint lookup should be %v, got %v", i, expected[i].Id, result.closest[i].Id)
+		}
+	}
+
+	contacted := make(map[string]bool)
+	for _, node := range result.contacted {
+		if contacted[string(node.Id)] {
+			t.Errorf("Node %v was queried on more than one path", node.Id)
+		}
+		contacted[string(node.Id)] = true
+	}
+}
+
+func TestDisjointLookupValue(t *testing.T) {
+	dhts := joinDhts(t, 12)
+	defer stopDhts(dhts)
+
+	data := []byte("disjoint value")
+	key := Hash(data)
+	for _, holder := range dhts[:4] {
+		holder.Data.Set(key, data, time.Now().Add(tExpire), tReplicate)
+	}
+
+	source := dhts[len(dhts)-1]
+	source.paths = 3
+	if value, _, _ := source.LookupValue(key); !bytes.Equal(value, data) {
+		t.Errorf("Disjoint lookup should find value %q, got %q", data, value)
+	}
+}
+
+// Paths should only be combined when a strict majority agree, with
+// paths finding nothing counting against the majority
+func TestMergePathsNeedsMajority(t *testing.T) {
+	a, b, c := NewNode(), NewNode(), NewNode()
+	target := Hash([]byte("target"))
+	withValue := func(value string) *lookupResult {
+		return &lookupResult{value: []byte(value), messages: 1, hops: 1}
+	}
+	withClosest := func(nodes ...*Node) *lookupResult {
+		sortByDistance(nodes, target)
+		return &lookupResult{closest: nodes, messages: 2, hops: 2}
+	}
+
+	merged := mergePaths([]*lookupResult{withValue("v"), withValue("v"), withValue("forged")}, newPathClaims(), target, 20)
+	if merged.disagreed || string(merged.value) != "v" || merged.messages != 3 || merged.hops != 1 {
+		t.Errorf("Value found by a majority of paths should be returned, got %+v", merged)
+	}
+
+	for name, paths := range map[string][]*lookupResult{
+		"conflicting values":         {withValue("v"), withValue("forged")},
+		"value found by a minority":  {withValue("v"), withClosest(a), withClosest(a)},
+		"conflicting closest nodes":  {withClosest(a), withClosest(b)},
+		"closest found by minority":  {withClosest(a), withClosest(b), {}},
+		"closest without a majority": {withClosest(a), withClosest(b), withClosest(c)},
+	} {
+		if merged := mergePaths(paths, newPathClaims(), target, 20); !merged.disagreed || merged.value != nil || merged.closest != nil {
+			t.Errorf("Paths with %s should disagree, got %+v", name, merged)
+		}
+	}
+
+	// The closest node of each path is the one closest to the target
+	nodes := []*Node{a, b, c}
+	sortByDistance(nodes, target)
+	merged = mergePaths([]*lookupResult{withClosest(nodes[0], nodes[1]), withClosest(nodes[0], nodes[2]), withClosest(nodes[1])}, newPathClaims(), target, 2)
+	if merged.disagreed || len(merged.closest) != 2 || !merged.closest[0].equals(nodes[0]) || !merged.closest[1].equals(nodes[1]) {
+		t.Errorf("Closest nodes of agreeing paths should be combined, got %+v", merged.closest)
+	}
+
+	// Contacts which failed to respond on one path are dropped from all
+	claims := newPathClaims()
+	claims.fail(nodes[0])
+	merged = mergePaths([]*lookupResult{withClosest(nodes[0], nodes[1]), withClosest(nodes[1])}, claims, target, 20)
+	if merged.disagreed || len(merged.closest) != 1 || !merged.closest[0].equals(nodes[1]) {
+		t.Errorf("Unresponsive contacts should be dropped before paths are compared, got %+v", merged.closest)
+	}
+}
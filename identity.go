@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+)
+
+// Use the given private key as the identity of this node, rather than
+// a freshly generated key, so that the node keeps its ID across runs
+func WithPrivateKey(privateKey ed25519.PrivateKey) DhtOption {
+	return func(d *Dht) {
+		d.setPrivateKey(privateKey)
+		d.keyGiven = true
+	}
+}
+
+// Take the given private key as our identity, deriving our ID from it
+func (d *Dht) setPrivateKey(privateKey ed25519.PrivateKey) {
+	d.privateKey = privateKey
+	d.Node.PublicKey = privateKey.Public().(ed25519.PublicKey)
+	d.Node.Id = nodeIdFor(d.Node.PublicKey)
+}
+
+// Derive the ID of a node from its public key
+func nodeIdFor(publicKey ed25519.PublicKey) []byte {
+	return Hash(publicKey)
+}
+
+// Whether the node has a public key, and an ID derived from it
+func (n *Node) hasValidId() bool {
+	return len(n.PublicKey) == ed25519.PublicKeySize && bytes.Equal(n.Id, nodeIdFor(n.PublicKey))
+}
+
+// Bytes of the message which its signature is made over, which are
+// the binary encoding of every field of the message other than the
+// signature, whichever codec the message is sent with
+func (m *Message) signedBytes() []byte {
+	return encodeBody(m).Bytes()
+}
+
+// Sign the message with our private key
+func (d *Dht) signMessage(msg *Message) {
+	msg.Signature = ed25519.Sign(d.privateKey, msg.signedBytes())
+}
+
+// Check that the sender of the message owns its ID, which must be
+// derived from the public key of the sender, and that the message
+// is signed with the matching private key
+func verifyMessage(msg *Message) error {
+	if !msg.Sender.hasValidId() {
+		return errors.New("sender ID is not derived from its public key")
+	}
+
+	if !ed25519.Verify(msg.Sender.PublicKey, msg.signedBytes(), msg.Signature) {
+		return errors.New("signature does not match sender")
+	}
+
+	return nil
+}
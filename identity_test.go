@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestNewIdentityDerivesId(t *testing.T) {
+	node, privateKey := NewIdentity()
+	if !node.hasValidId() {
+		t.Errorf("ID of new node should be derived from its public key")
+	}
+
+	if !bytes.Equal(privateKey.Public().(ed25519.PublicKey), node.PublicKey) {
+		t.Errorf("Public key of new node should match its private key")
+	}
+}
+
+// A node given the same private key should take the same ID
+func TestWithPrivateKeyKeepsId(t *testing.T) {
+	_, privateKey := NewIdentity()
+	first := NewDht(WithPrivateKey(privateKey))
+	defer first.Close()
+	second := NewDht(WithPrivateKey(privateKey))
+	defer second.Close()
+
+	if !bytes.Equal(first.Node.Id, second.Node.Id) || !first.Node.hasValidId() {
+		t.Errorf("Nodes with the same private key should have the same derived ID")
+	}
+}
+
+// Messages should only verify if signed by the key their sender ID is
+// derived from, and left untouched since
+func TestVerifyMessage(t *testing.T) {
+	d := NewDht()
+	defer d.Close()
+	other := NewDht()
+	defer other.Close()
+
+	signed := func(edit func(msg *Message)) *Message {
+		msg := d.formFindNodeMsg([]byte("key"))
+		edit(msg)
+		return msg
+	}
+
+	good := signed(func(msg *Message) { d.signMessage(msg) })
+	if err := verifyMessage(good); err != nil {
+		t.Errorf("Signed message should verify, error: %s", err)
+	}
+
+	cases := map[string]*Message{
+		"tampered field": signed(func(msg *Message) {
+			d.signMessage(msg)
+			msg.Key = []byte("other key")
+		}),
+		"signed by another key": signed(func(msg *Message) {
+			other.signMessage(msg)
+		}),
+		"rebound ID": signed(func(msg *Message) {
+			msg.Sender = &Node{Id: other.Node.Id, PublicKey: d.Node.PublicKey, Addr: d.Node.Addr, Port: d.Node.Port}
+			d.signMessage(msg)
+		}),
+		"missing public key": signed(func(msg *Message) {
+			msg.Sender = &Node{Id: d.Node.Id, Addr: d.Node.Addr, Port: d.Node.Port}
+			d.signMessage(msg)
+		}),
+		"missing signature": signed(func(msg *Message) {}),
+	}
+
+	for name, msg := range cases {
+		if err := verifyMessage(msg); err == nil {
+			t.Errorf("Message with %s should not verify", name)
+		}
+	}
+}
+
+// Messages from a node claiming an ID it does not own should be
+// dropped, without the node being placed in the k-buckets
+func TestRejectsSpoofedSender(t *testing.T) {
+	dhts, _ := startSimDhts(2, WithRPCTimeout(50*time.Millisecond))
+	defer stopDhts(dhts)
+	spoofer := dhts[1]
+	spoofer.Node.dummyIdWithNthByteSet(0, 0x80)
+
+	if err := spoofer.pingNode(dhts[0].Node); err == nil {
+		t.Errorf("Ping from node with spoofed ID should not be answered")
+	}
+
+	if knowsNode(dhts[0], spoofer.Node) {
+		t.Errorf("Node with spoofed ID should not be placed in k-buckets")
+	}
+}
+
+// A response should only be accepted from the node the request was
+// made to, even if signed by its sender
+func TestCallRejectsResponseFromOtherNode(t *testing.T) {
+	dhts, _ := startSimDhts(2, WithRPCTimeout(50*time.Millisecond))
+	defer stopDhts(dhts)
+
+	impostor := *dhts[1].Node
+	impostor.Id = NewNode().Id
+	if err := dhts[0].pingNode(&impostor); err == nil {
+		t.Errorf("Response from node other than the one pinged should be rejected")
+	}
+
+	if err := dhts[0].pingNode(dhts[1].Node); err != nil {
+		t.Errorf("Error pinging node, error: %s", err)
+	}
+}
+
+// Contacts learned from other nodes whose ID is not derived from
+// their public key should not be queried by lookups
+func TestShortlistSkipsUnboundContacts(t *testing.T) {
+	d := NewDht()
+	defer d.Close()
+
+	unbound := NewNode()
+	unbound.dummyId()
+
+	list := newShortlist(unbound.Id, d.Node.Id, maxNodesInBucket)
+	list.add([]*Node{unbound, NewNode()})
+	if len(list.nodes) != 1 || list.nodes[0].equals(unbound) {
+		t.Errorf("Shortlist should only hold the contact with a derived ID, got %d contacts", len(list.nodes))
+	}
+}
@@ -15,40 +15,76 @@ type Value struct {
 	ExpirationTime      time.Time
 	LastTimeReplicated  time.Time
 	ReplicationInterval time.Duration
+	// Whether this node originally published the pair, in which
+	// case it republishes the pair, rather than replicating it
+	OriginalPublisher bool
+	LastTimePublished time.Time
+	// Whether the pair is only held as a cached copy, which is
+	// neither replicated nor handed off to other nodes
+	Cached bool
 }
 
 type kvstore struct {
 	mtx sync.RWMutex
 	// The hash table of key/value pairs.
 	table map[string]*Value
+	// Clock which timeouts are measured against
+	clock Clock
 }
 
 // Instantiate key-value store
 func NewKVStore() *kvstore {
-	k := &kvstore{table: make(map[string]*Value), mtx: sync.RWMutex{}}
+	k := &kvstore{table: make(map[string]*Value), mtx: sync.RWMutex{}, clock: systemClock{}}
 	return k
 }
 
 // Iterate through the key/value pairs in the hash table
 // and delete any pairs from the table for which the
 // expiration time has passed, should be done periodically
-// to avoid congesting table with data
-func (k *kvstore) FlushExpiredPairs() {
+// to avoid congesting table with data. Pairs we originally
+// published are kept, as they are republished to the network.
+// Returns the number of pairs deleted.
+func (k *kvstore) FlushExpiredPairs() int {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	flushed := 0
+	now := k.clock.Now()
 	for key, value := range k.table {
-		if value.ExpirationTime.Before(time.Now()) {
+		if !value.OriginalPublisher && value.ExpirationTime.Before(now) {
 			delete(k.table, key)
+			flushed++
 		}
 	}
+
+	return flushed
 }
 
 // Iterate through the key/value pairs in the hash table
-// and fetch all keys which have surpassed their replication interval
+// and fetch all keys which have surpassed their replication interval.
+// Pairs we originally published are republished instead, and cached
+// copies are left to expire.
 func (k *kvstore) GetKeysForReplicaion() [][]byte {
 	k.mtx.RLock()
 	defer k.mtx.RUnlock()
 	var keys [][]byte
 	for key, value := range k.table {
-		if value.LastTimeReplicated.Add(value.ReplicationInterval).Before(time.Now()) {
+		if !value.OriginalPublisher && !value.Cached && value.LastTimeReplicated.Add(value.ReplicationInterval).Before(k.clock.Now()) {
+			keys = append(keys, []byte(key))
+		}
+	}
+
+	return keys
+}
+
+// Iterate through the key/value pairs in the hash table and
+// fetch all keys we originally published which were last
+// published at least tRepublish ago
+func (k *kvstore) GetKeysForRepublishing() [][]byte {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	var keys [][]byte
+	for key, value := range k.table {
+		if value.OriginalPublisher && !value.LastTimePublished.Add(tRepublish).After(k.clock.Now()) {
 			keys = append(keys, []byte(key))
 		}
 	}
@@ -56,6 +92,18 @@ func (k *kvstore) GetKeysForReplicaion() [][]byte {
 	return keys
 }
 
+// Get all keys in the hash table
+func (k *kvstore) Keys() [][]byte {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	keys := make([][]byte, 0, len(k.table))
+	for key := range k.table {
+		keys = append(keys, []byte(key))
+	}
+
+	return keys
+}
+
 // Get the value for the given key, if found
 func (k *kvstore) Get(key []byte) (value []byte, error error) {
 	k.mtx.RLock()
@@ -66,14 +114,94 @@ func (k *kvstore) Get(key []byte) (value []byte, error error) {
 	return nil, errors.New(fmt.Sprintf("Key %s not found", key))
 }
 
+// Get a copy of the value for the given key along with its
+// timeouts, if found
+func (k *kvstore) GetValue(key []byte) (*Value, error) {
+	k.mtx.RLock()
+	defer k.mtx.RUnlock()
+	if v, ok := k.table[string(key)]; ok {
+		value := *v
+		return &value, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Key %s not found", key))
+}
+
+// Record that the pair for the given key has just been replicated,
+// restarting its replication timer
+func (k *kvstore) MarkReplicated(key []byte) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if v, ok := k.table[string(key)]; ok {
+		v.LastTimeReplicated = k.clock.Now()
+	}
+}
+
 // Set the value for the given key. We enforce a timeout on the
 // pair to avoid congesting the hash table with too much stale
 // data, as well as a replication timer, which enforces how
-// often the pair should be replicated to other nodes
+// often the pair should be replicated to other nodes. Setting
+// a pair we already hold never makes it expire sooner.
 func (k *kvstore) Set(key []byte, value []byte, expirationTime time.Time, replicationInterval time.Duration) {
 	k.mtx.Lock()
 	defer k.mtx.Unlock()
-	k.table[string(key)] = &Value{Value: value, ExpirationTime: expirationTime, LastTimeReplicated: time.Now(), ReplicationInterval: replicationInterval}
+	k.set(key, value, expirationTime, replicationInterval)
+}
+
+// Set the value for the given key as a cached copy, unless we already
+// hold the pair, in which case it is set as usual, and stays cached
+// only if it was cached before
+func (k *kvstore) Cache(key []byte, value []byte, expirationTime time.Time, replicationInterval time.Duration) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	existing, held := k.table[string(key)]
+	cached := !held || existing.Cached
+	k.set(key, value, expirationTime, replicationInterval).Cached = cached
+}
+
+// Set the value for the given key with the lock held, returning
+// the new value
+func (k *kvstore) set(key []byte, value []byte, expirationTime time.Time, replicationInterval time.Duration) *Value {
+	v := &Value{Value: heldValue(value), ExpirationTime: expirationTime, LastTimeReplicated: k.clock.Now(), ReplicationInterval: replicationInterval}
+
+	existing, ok := k.table[string(key)]
+	if ok && existing.ExpirationTime.After(v.ExpirationTime) {
+		v.ExpirationTime = existing.ExpirationTime
+	}
+
+	// Pairs we originally published stay so when stored by others
+	if ok && existing.OriginalPublisher {
+		v.OriginalPublisher = true
+		v.LastTimePublished = existing.LastTimePublished
+	}
+
+	k.table[string(key)] = v
+	return v
+}
+
+// Set the value for the given key, as the original publisher of the
+// pair, which restarts the republishing timer for the pair
+func (k *kvstore) Publish(key []byte, value []byte, expirationTime time.Time, replicationInterval time.Duration) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	now := k.clock.Now()
+	k.table[string(key)] = &Value{
+		Value:               heldValue(value),
+		ExpirationTime:      expirationTime,
+		LastTimeReplicated:  now,
+		ReplicationInterval: replicationInterval,
+		OriginalPublisher:   true,
+		LastTimePublished:   now,
+	}
+}
+
+// Values are held as non-nil byte strings, so that an empty value
+// is found, rather than taken for a missing one
+func heldValue(value []byte) []byte {
+	if value == nil {
+		return []byte{}
+	}
+
+	return value
 }
 
 // Delete the value for the given key, if found.
@@ -28,3 +28,65 @@ func TestHashSetAndGet(t *testing.T) {
 		t.Error("Error getting value:", value)
 	}
 }
+
+// Pairs we published should be republished rather than replicated,
+// and should stay published when stored by another node
+func TestPublishedPairs(t *testing.T) {
+	clock := newFakeClock()
+	kvstore := NewKVStore()
+	kvstore.clock = clock
+
+	published, replica := Hash([]byte("published")), Hash([]byte("replica"))
+	kvstore.Publish(published, []byte("published"), clock.Now().Add(-time.Minute), -time.Minute)
+	kvstore.Set(replica, []byte("replica"), clock.Now().Add(-time.Minute), -time.Minute)
+
+	if keys := kvstore.GetKeysForReplicaion(); len(keys) != 1 || !bytes.Equal(keys[0], replica) {
+		t.Errorf("Only replica should be due for replication, got %v", keys)
+	}
+
+	if keys := kvstore.GetKeysForRepublishing(); len(keys) != 0 {
+		t.Errorf("No pair should be due for republishing, got %v", keys)
+	}
+
+	clock.Advance(tRepublish)
+
+	if keys := kvstore.GetKeysForRepublishing(); len(keys) != 1 || !bytes.Equal(keys[0], published) {
+		t.Errorf("Published pair should be due for republishing, got %v", keys)
+	}
+
+	// Another node storing the published pair does not take it over
+	kvstore.Set(published, []byte("published"), clock.Now().Add(time.Hour), tReplicate)
+	if value, _ := kvstore.GetValue(published); !value.OriginalPublisher {
+		t.Errorf("Pair should still be published after being stored")
+	}
+
+	// Expired pairs are flushed, unless we published them
+	clock.Advance(time.Hour + time.Minute)
+	kvstore.FlushExpiredPairs()
+	if _, err := kvstore.Get(published); err != nil {
+		t.Errorf("Published pair should not be flushed")
+	}
+
+	if _, err := kvstore.Get(replica); err == nil {
+		t.Errorf("Expired replica should be flushed")
+	}
+}
+
+// Storing a pair we already hold should only ever extend its expiration
+func TestSetKeepsLaterExpiration(t *testing.T) {
+	kvstore := NewKVStore()
+	key := Hash([]byte("data"))
+	later := time.Now().Add(tExpire)
+
+	kvstore.Set(key, []byte("data"), later, tReplicate)
+	kvstore.Set(key, []byte("data"), time.Now().Add(time.Minute), tReplicate)
+	if value, _ := kvstore.GetValue(key); !value.ExpirationTime.Equal(later) {
+		t.Errorf("Pair should still expire at %s, expires at %s", later, value.ExpirationTime)
+	}
+
+	latest := later.Add(time.Hour)
+	kvstore.Set(key, []byte("data"), latest, tReplicate)
+	if value, _ := kvstore.GetValue(key); !value.ExpirationTime.Equal(latest) {
+		t.Errorf("Pair should be extended to expire at %s, expires at %s", latest, value.ExpirationTime)
+	}
+}
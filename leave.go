@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+func (d *Dht) formLeaveMsg() *Message {
+	return &Message{
+		Type:   LeaveMsg,
+		MsgId:  GenerateMsgId(),
+		Sender: d.Node,
+	}
+}
+
+func (d *Dht) isLeaving() bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.leaving
+}
+
+// Serve a LEAVE notification, removing the departing node from our
+// k-buckets, with a replacement candidate promoted in its place
+func (d *Dht) NodeLeaving(ReqMsg *Message) (*Message, error) {
+	writeLog("Serving leave with ID %v\n", ReqMsg.MsgId)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.removeFromKBucket(d.getHighestAllowableBucketIndex(ReqMsg.Sender.Id), ReqMsg.Sender)
+
+	return nil, nil
+}
+
+// Leave the network gracefully. We stop serving requests and stop our
+// background loops, then push every pair in our store to the k closest
+// live nodes to its key other than ourselves, and notify every node in
+// our k-buckets that we are leaving, before closing the listener. If
+// the context is done before the handoff completes, the remaining
+// pairs are abandoned and the context error is returned, but resources
+// are still released.
+func (d *Dht) Leave(ctx context.Context) error {
+	writeLog("Leaving the kademlia network")
+	d.mtx.Lock()
+	d.leaving = true
+	d.mtx.Unlock()
+
+	d.stopLoops()
+	defer d.Listener.Close()
+
+	if err := d.handOffKeys(ctx); err != nil {
+		return err
+	}
+
+	d.notifyNeighbors(ctx)
+	return ctx.Err()
+}
+
+// Push each pair in our store to the k closest nodes to its key,
+// keeping the expiration time of the pair. Cached copies are left
+// to expire.
+func (d *Dht) handOffKeys(ctx context.Context) error {
+	for _, key := range d.Data.Keys() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		value, err := d.Data.GetValue(key)
+		if err != nil || value.Cached || value.ExpirationTime.Before(d.clock.Now()) {
+			continue
+		}
+
+		msg := d.formStoreKeyMsg(key, value.Value)
+		msg.ExpirationTime = value.ExpirationTime
+		msg.ReplicationInterval = value.ReplicationInterval
+		stored := d.storeOnNodes(d.LookupNode(key), msg)
+		writeLog("Handed off key %v to %d nodes\n", key, stored)
+	}
+
+	return nil
+}
+
+// Notify every node in our k-buckets that we are leaving, in parallel.
+// Nodes which do not handle LEAVE notifications are skipped, as they
+// find out we left once we fail to respond to them. Returns the number
+// of nodes notified.
+func (d *Dht) notifyNeighbors(ctx context.Context) int {
+	d.mtx.Lock()
+	var neighbors []*Node
+	for _, bucket := range d.Buckets {
+		for _, node := range bucket {
+			if node.Capabilities.Has(CapLeave) {
+				neighbors = append(neighbors, node)
+			}
+		}
+	}
+	d.mtx.Unlock()
+
+	var wg sync.WaitGroup
+	notified := 0
+	for _, neighbor := range neighbors {
+		if ctx.Err() != nil {
+			break
+		}
+
+		notified++
+		wg.Add(1)
+		go func(neighbor *Node) {
+			defer wg.Done()
+			d.sendMessageToNode(d.formLeaveMsg(), neighbor)
+		}(neighbor)
+	}
+	wg.Wait()
+
+	return notified
+}
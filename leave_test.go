@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Spin up n dhts, joining each to the network through the first
+func joinDhts(t *testing.T, n int) []*Dht {
+	dhts, _ := startSimDhts(n)
+	for _, dht := range dhts[1:] {
+		if _, err := dht.join(dhts[0].Node.Addr, dhts[0].Node.Port); err != nil {
+			t.Fatalf("Error joining network, error: %s", err)
+		}
+	}
+
+	return dhts
+}
+
+// A leaving node should hand off the pairs only it holds to the
+// remaining nodes, and be removed from their k-buckets
+func TestLeaveHandsOffKeys(t *testing.T) {
+	dhts := joinDhts(t, 5)
+	defer stopDhts(dhts)
+	leaving, remaining := dhts[0], dhts[1:]
+
+	var keys [][]byte
+	for i := 0; i < 10; i++ {
+		data := []byte{byte(i)}
+		leaving.Data.Set(Hash(data), data, time.Now().Add(time.Hour), tReplicate)
+		keys = append(keys, Hash(data))
+	}
+
+	if err := leaving.Leave(context.Background()); err != nil {
+		t.Fatalf("Error leaving network, error: %s", err)
+	}
+
+	for _, key := range keys {
+		for i, dht := range remaining {
+			if _, err := dht.Data.Get(key); err != nil {
+				t.Errorf("Node %d should hold key %v after handoff", i+1, key)
+			}
+		}
+	}
+
+	for i, dht := range remaining {
+		waitFor(t, time.Second, func() bool { return !knowsNode(dht, leaving.Node) })
+
+		if count := dht.nodeCount(); count != len(remaining)-1 {
+			t.Errorf("Node %d should know %d nodes after leave, knows %d", i+1, len(remaining)-1, count)
+		}
+	}
+
+	if err := remaining[0].pingNode(leaving.Node); err == nil {
+		t.Errorf("Leaving node should no longer accept connections")
+	}
+}
+
+// Leaving with a context which is already done should abandon the
+// handoff, but still release resources
+func TestLeaveCancelled(t *testing.T) {
+	dhts := joinDhts(t, 2)
+	defer stopDhts(dhts)
+	leaving := dhts[0]
+
+	data := []byte("abandoned")
+	leaving.Data.Set(Hash(data), data, time.Now().Add(time.Hour), tReplicate)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := leaving.Leave(ctx); err != context.Canceled {
+		t.Errorf("Leave with cancelled context should return %s, got %v", context.Canceled, err)
+	}
+
+	if _, err := dhts[1].Data.Get(Hash(data)); err == nil {
+		t.Errorf("Pair should not be handed off after context is cancelled")
+	}
+
+	if err := dhts[1].pingNode(leaving.Node); err == nil {
+		t.Errorf("Leaving node should no longer accept connections")
+	}
+}
+
+// Check whether the node is in the k-buckets of the dht
+func knowsNode(d *Dht, other *Node) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, node := range d.Buckets[d.getHighestAllowableBucketIndex(other.Id)] {
+		if node.equals(other) {
+			return true
+		}
+	}
+
+	return false
+}
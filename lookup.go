@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Shortlist of contacts tracked by an iterative lookup, which is
+// kept sorted by increasing distance to the lookup target. Nodes
+// are never queried twice, and nodes which fail to respond are
+// dropped from the shortlist. On a path of a disjoint lookup, the
+// claims of the other paths are shared, and contacts claimed by
+// another path are left to it.
+type shortlist struct {
+	target  []byte
+	self    []byte
+	k       int
+	nodes   []*Node
+	seen    map[string]bool
+	queried map[string]bool
+	claims  *pathClaims
+}
+
+func newShortlist(target []byte, self []byte, k int) *shortlist {
+	return &shortlist{
+		target:  target,
+		self:    self,
+		k:       k,
+		seen:    make(map[string]bool),
+		queried: make(map[string]bool),
+	}
+}
+
+// Add contacts to the shortlist, skipping this node, contacts of
+// incompatible protocol versions, contacts whose ID is not derived
+// from their public key, and any contact which has been seen before
+// in the lookup
+func (s *shortlist) add(nodes []*Node) {
+	for _, node := range nodes {
+		if node == nil || bytes.Equal(node.Id, s.self) || s.seen[string(node.Id)] ||
+			!compatibleVersion(node.Version) || !node.hasValidId() {
+			continue
+		}
+
+		s.seen[string(node.Id)] = true
+		s.nodes = append(s.nodes, node)
+	}
+
+	sortByDistance(s.nodes, s.target)
+}
+
+// Remove a contact which failed to respond from the shortlist
+func (s *shortlist) remove(other *Node) {
+	if s.claims != nil {
+		s.claims.fail(other)
+	}
+
+	for i, node := range s.nodes {
+		if bytes.Equal(node.Id, other.Id) {
+			s.nodes = append(s.nodes[:i], s.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get up to n of the closest contacts among the k closest in the
+// shortlist which have not yet been queried, marking them as queried.
+// Contacts claimed by another path are marked as queried, but left out.
+func (s *shortlist) next(n int) []*Node {
+	var batch []*Node
+	for i := 0; i < len(s.nodes) && i < s.k && len(batch) < n; i++ {
+		if s.queried[string(s.nodes[i].Id)] {
+			continue
+		}
+
+		s.queried[string(s.nodes[i].Id)] = true
+		if s.claims == nil || s.claims.claim(s.nodes[i]) {
+			batch = append(batch, s.nodes[i])
+		}
+	}
+
+	return batch
+}
+
+// Get the k closest contacts in the shortlist
+func (s *shortlist) closest() []*Node {
+	if len(s.nodes) > s.k {
+		return s.nodes[:s.k]
+	}
+
+	return s.nodes
+}
+
+// Result of an iterative lookup. For value lookups, the value is
+// set if some contact held it, and missing holds the contacts which
+// responded without the value, sorted by distance to the key. Hops
+// counts the rounds of requests sent, messages the requests sent, and
+// contacted holds the contacts they were sent to. Disagreed is set
+// for disjoint lookups whose paths disagreed, which have no results.
+type lookupResult struct {
+	closest   []*Node
+	value     []byte
+	missing   []*Node
+	hops      int
+	messages  int
+	contacted []*Node
+	disagreed bool
+}
+
+// Send a FIND_NODE request for the target to the given contact, or
+// a FIND_VALUE request if we are looking up the value for a key
+func (d *Dht) findRPC(contact *Node, target []byte, findValue bool) (*Message, error) {
+	msg := d.formFindNodeMsg(target)
+	if findValue {
+		msg = d.formFindKeyMsg(target)
+	}
+
+	return d.call(msg, contact, d.rpcTimeout)
+}
+
+// Perform an iterative lookup, locating the k nodes in the network
+// which are closest to the target ID. The lookup is seeded with the
+// closest contacts in our own k-buckets, and in each round queries
+// alpha of the closest contacts which have not yet been queried in
+// parallel, merging the contacts they return into the shortlist.
+// The lookup terminates once each of the k closest contacts in the
+// shortlist has been queried and responded, or for value lookups,
+// as soon as a contact responds with the value. With more than one
+// disjoint path, the lookup is split over the paths.
+func (d *Dht) iterativeLookup(target []byte, findValue bool) *lookupResult {
+	d.markLookup(target)
+	if d.paths > 1 {
+		return d.disjointLookup(target, findValue)
+	}
+
+	list := newShortlist(target, d.Node.Id, d.k)
+	list.add(d.getKNearestNodes(target, nil))
+	return d.lookupPath(list, target, findValue)
+}
+
+// Perform the rounds of an iterative lookup over the shortlist
+func (d *Dht) lookupPath(list *shortlist, target []byte, findValue bool) *lookupResult {
+	result := &lookupResult{}
+	for result.value == nil {
+		batch := list.next(d.alpha)
+		if len(batch) == 0 {
+			break
+		}
+
+		result.hops++
+		result.messages += len(batch)
+		result.contacted = append(result.contacted, batch...)
+
+		responses := make([]*Message, len(batch))
+		errs := make([]error, len(batch))
+
+		var wg sync.WaitGroup
+		for i, contact := range batch {
+			wg.Add(1)
+			go func(i int, contact *Node) {
+				defer wg.Done()
+				responses[i], errs[i] = d.findRPC(contact, target, findValue)
+			}(i, contact)
+		}
+		wg.Wait()
+
+		for i, contact := range batch {
+			if errs[i] != nil {
+				list.remove(contact)
+				continue
+			}
+
+			if responses[i].Value != nil {
+				if result.value == nil {
+					result.value = responses[i].Value
+				}
+				continue
+			}
+
+			if findValue {
+				result.missing = append(result.missing, contact)
+			}
+			list.add(responses[i].KNearestNodes)
+		}
+	}
+
+	result.closest = list.closest()
+	sortByDistance(result.missing, target)
+	return result
+}
+
+// Locate the k nodes in the network which are closest to the target
+// ID. A disjoint lookup whose paths disagree locates no nodes.
+func (d *Dht) LookupNode(target []byte) []*Node {
+	writeLog("Looking up node %v\n", target)
+	return d.iterativeLookup(target, false).closest
+}
+
+// Look up the value for the given key, which is returned if any node
+// in the network holds it. Otherwise the value is nil, and the k nodes
+// closest to the key are returned instead. When the value is found, it
+// is cached at the closest node queried which did not hold the value.
+// A disjoint lookup whose paths disagree finds neither. Returns an error
+// if the key is not the size of an ID.
+func (d *Dht) LookupValue(key []byte) ([]byte, []*Node, error) {
+	writeLog("Looking up value %v\n", key)
+	if err := checkKeySize(key); err != nil {
+		return nil, nil, err
+	}
+
+	if value, err := d.Data.Get(key); err == nil {
+		return value, nil, nil
+	}
+
+	result := d.iterativeLookup(key, true)
+	if result.value == nil {
+		return nil, result.closest, nil
+	}
+
+	if len(result.missing) > 0 {
+		cache := result.missing[0]
+		writeLog("Caching value %v at node %v\n", key, cache.Id)
+		msg := d.formStoreKeyMsg(key, result.value)
+		msg.Cached = true
+		d.sendMessageToNode(msg, cache)
+	}
+
+	return result.value, nil, nil
+}
+
+// Check that the key is the size of an ID, as keys are placed in the
+// range of a bucket in the same way as IDs
+func checkKeySize(key []byte) error {
+	if len(key) != keysize {
+		return fmt.Errorf("key of %d bytes, expected %d", len(key), keysize)
+	}
+
+	return nil
+}
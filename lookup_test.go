@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// For a network where each node only knows of the one before
+// it, a lookup from the last node should locate the first node
+func TestLookupNodeFindsTarget(t *testing.T) {
+	dhts, _ := startSimDhts(8)
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	first, last := dhts[0], dhts[len(dhts)-1]
+	result := last.LookupNode(first.Node.Id)
+	if len(result) == 0 {
+		t.Fatalf("Lookup for node %v returned no nodes", first.Node.Id)
+	}
+
+	if !bytes.Equal(result[0].Id, first.Node.Id) {
+		t.Errorf("Closest node should be %v, got %v", first.Node.Id, result[0].Id)
+	}
+}
+
+// With fewer than k nodes in the network, a lookup for any
+// target should return every other node, ordered by distance
+func TestLookupNodeReturnsClosestNodes(t *testing.T) {
+	dhts, _ := startSimDhts(10)
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	target := Hash([]byte("lookup target"))
+	last := dhts[len(dhts)-1]
+
+	var expected []*Node
+	for _, dht := range dhts[:len(dhts)-1] {
+		expected = append(expected, dht.Node)
+	}
+	sortByDistance(expected, target)
+
+	result := last.LookupNode(target)
+	if len(result) != len(expected) {
+		t.Fatalf("Lookup should return %d nodes, got %d", len(expected), len(result))
+	}
+
+	for i := range expected {
+		if !bytes.Equal(result[i].Id, expected[i].Id) {
+			t.Errorf("Node %d of lookup should be %v, got %v", i, expected[i].Id, result[i].Id)
+		}
+	}
+
+	// Every node contacted during the lookup should now be
+	// known to the node which performed it
+	if count := last.nodeCount(); count != len(expected) {
+		t.Errorf("Node count after lookup should be %d, got %d", len(expected), count)
+	}
+}
+
+// A value held only by the first node of the chain should be found
+// by the last node, and then be cached at another node on the path
+func TestLookupValueFromFarNode(t *testing.T) {
+	dhts, _ := startSimDhts(8)
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	data := []byte("far away value")
+	key := Hash(data)
+	holder, last := dhts[0], dhts[len(dhts)-1]
+	holder.Data.Set(key, data, time.Now().Add(tExpire), tReplicate)
+
+	value, closest, err := last.LookupValue(key)
+	if err != nil {
+		t.Fatalf("Error looking up key %v, error: %s", key, err)
+	}
+	if !bytes.Equal(value, data) {
+		t.Fatalf("Lookup for key %v should return %s, got %s", key, data, value)
+	}
+
+	if closest != nil {
+		t.Errorf("Lookup which found the value should not return nodes, got %d", len(closest))
+	}
+
+	// The value should be cached at exactly one node besides the holder
+	cachedAt := func() int {
+		count := 0
+		for _, dht := range dhts[1:] {
+			if cached, err := dht.Data.Get(key); err == nil && bytes.Equal(cached, data) {
+				count++
+			}
+		}
+		return count
+	}
+	waitFor(t, time.Second, func() bool { return cachedAt() == 1 })
+}
+
+// A value held by no node should not be found, and the lookup
+// should instead return the closest nodes to the key
+func TestLookupValueMissing(t *testing.T) {
+	dhts, _ := startSimDhts(6)
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	key := Hash([]byte("missing value"))
+	value, closest, err := dhts[len(dhts)-1].LookupValue(key)
+	if err != nil {
+		t.Fatalf("Error looking up key %v, error: %s", key, err)
+	}
+	if value != nil {
+		t.Errorf("Lookup for missing key should not return a value, got %s", value)
+	}
+
+	if len(closest) != len(dhts)-1 {
+		t.Errorf("Lookup for missing key should return %d nodes, got %d", len(dhts)-1, len(closest))
+	}
+}
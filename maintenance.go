@@ -0,0 +1,108 @@
+package main
+
+import (
+	"time"
+)
+
+// Run fn every interval in the background, until the background
+// loops of the dht are stopped
+func (d *Dht) runPeriodically(interval time.Duration, fn func()) {
+	// The ticker starts now, rather than once the loop is scheduled
+	ticker := d.clock.NewTicker(interval)
+	d.loops.Add(1)
+	go func() {
+		defer d.loops.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.Chan():
+				fn()
+			case <-d.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop all background loops of the dht, waiting for them and for any
+// evictions in progress to exit. The quit channel is closed with the
+// lock held, so no eviction starts once we are waiting.
+func (d *Dht) stopLoops() {
+	d.stopOnce.Do(func() {
+		d.mtx.Lock()
+		close(d.quit)
+		d.mtx.Unlock()
+	})
+	d.loops.Wait()
+}
+
+// Whether the background loops have been stopped. Must be called
+// with the lock held.
+func (d *Dht) stopping() bool {
+	select {
+	case <-d.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Record that a lookup was performed for the target, which
+// refreshes the bucket whose range the target falls into
+func (d *Dht) markLookup(target []byte) {
+	bucketIndex := d.getHighestAllowableBucketIndex(target)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.lastLookup[bucketIndex] = d.clock.Now()
+}
+
+// Refresh each bucket which has not had a lookup in the past tRefresh,
+// by looking up a random ID in the range of the bucket. Buckets closer
+// to us than our closest neighbor are skipped, as they hold no nodes
+// and lookups for IDs in their range all end at the same neighbors.
+// Returns the number of buckets refreshed.
+func (d *Dht) refreshBuckets() int {
+	var stale []int
+
+	d.mtx.Lock()
+	closestIndex := 0
+	for closestIndex < numBuckets && len(d.Buckets[closestIndex]) == 0 {
+		closestIndex++
+	}
+
+	for i := closestIndex; i < numBuckets; i++ {
+		if d.clock.Now().Sub(d.lastLookup[i]) >= tRefresh {
+			stale = append(stale, i)
+		}
+	}
+	d.mtx.Unlock()
+
+	for _, bucketIndex := range stale {
+		writeLog("Refreshing bucket %d\n", bucketIndex)
+		d.LookupNode(d.randomIdInBucket(bucketIndex))
+	}
+
+	return len(stale)
+}
+
+// Start the background loop which refreshes stale buckets
+func (d *Dht) startRefresh() {
+	d.runPeriodically(tMaintenance, func() { d.refreshBuckets() })
+}
+
+// Purge the expired pairs from our store, returning the number purged
+func (d *Dht) sweepExpired() int {
+	purged := d.Data.FlushExpiredPairs()
+	if purged > 0 {
+		writeLog("Purged %d expired pairs\n", purged)
+	}
+
+	return purged
+}
+
+// Start the background loop which purges expired pairs
+func (d *Dht) startSweeper() {
+	d.runPeriodically(tMaintenance, func() { d.sweepExpired() })
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Stale buckets should be refreshed with a lookup, which discovers
+// nodes the refreshing node did not know of
+func TestRefreshStaleBuckets(t *testing.T) {
+	clock := newFakeClock()
+	dhts, _ := startSimDhts(6, WithClock(clock))
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	last := dhts[len(dhts)-1]
+	clock.Advance(2 * tRefresh)
+
+	closestIndex := last.getHighestAllowableBucketIndex(last.getKNearestNodes(last.Node.Id, nil)[0].Id)
+	if refreshed := last.refreshBuckets(); refreshed != numBuckets-closestIndex {
+		t.Errorf("Expected %d buckets to be refreshed, got %d", numBuckets-closestIndex, refreshed)
+	}
+
+	if count := last.nodeCount(); count != len(dhts)-1 {
+		t.Errorf("Node count after refresh should be %d, got %d", len(dhts)-1, count)
+	}
+
+	// Every bucket refreshed should now be fresh
+	for i := closestIndex; i < numBuckets; i++ {
+		if clock.Now().Sub(last.lastLookup[i]) >= tRefresh {
+			t.Errorf("Bucket %d should be fresh after refresh", i)
+		}
+	}
+
+	// Discovering nodes may bring the closest neighbor closer, making
+	// more buckets eligible for refresh, but each is refreshed once
+	last.refreshBuckets()
+	if refreshed := last.refreshBuckets(); refreshed != 0 {
+		t.Errorf("Fresh buckets should not be refreshed, got %d refreshed", refreshed)
+	}
+}
+
+// Lookups should keep the bucket of their target fresh
+func TestLookupMarksBucketFresh(t *testing.T) {
+	clock := newFakeClock()
+	dhts, _ := startSimDhts(2, WithClock(clock))
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	d := dhts[1]
+	clock.Advance(2 * tRefresh)
+
+	target := d.randomIdInBucket(numBuckets - 1)
+	d.LookupNode(target)
+
+	if clock.Now().Sub(d.lastLookup[numBuckets-1]) >= tRefresh {
+		t.Errorf("Bucket %d should be fresh after lookup", numBuckets-1)
+	}
+
+	if clock.Now().Sub(d.lastLookup[numBuckets-2]) < tRefresh {
+		t.Errorf("Bucket %d should still be stale", numBuckets-2)
+	}
+}
+
+// Background loops should run on each tick of the clock until stopped
+func TestRunPeriodicallyUntilStopped(t *testing.T) {
+	clock := newFakeClock()
+	d := NewDht(WithClock(clock))
+	defer d.Listener.Close()
+
+	ticks := make(chan struct{}, 100)
+	d.runPeriodically(time.Minute, func() { ticks <- struct{}{} })
+
+	clock.Advance(time.Minute)
+	<-ticks
+	clock.Advance(time.Minute)
+	<-ticks
+	d.stopLoops()
+
+	clock.Advance(time.Minute)
+	if len(ticks) != 0 {
+		t.Errorf("Loop should not run after being stopped")
+	}
+}
+
+// The sweeper should purge only expired pairs, and report how many
+func TestSweepExpiredPairs(t *testing.T) {
+	d := NewDht()
+	defer d.Close()
+
+	for i := 0; i < 5; i++ {
+		data := []byte{byte(i)}
+		d.Data.Set(Hash(data), data, time.Now().Add(-time.Minute), tReplicate)
+	}
+
+	live := []byte("live")
+	d.Data.Set(Hash(live), live, time.Now().Add(time.Hour), tReplicate)
+
+	if purged := d.sweepExpired(); purged != 5 {
+		t.Errorf("Expected 5 expired pairs to be purged, got %d", purged)
+	}
+
+	if _, err := d.Data.Get(Hash(live)); err != nil {
+		t.Errorf("Live pair should not be purged")
+	}
+
+	if purged := d.sweepExpired(); purged != 0 {
+		t.Errorf("Expected no pairs to be purged, got %d", purged)
+	}
+}
+
+// Closing the dht should stop the background loops, even while
+// pairs are being written concurrently, and may be done twice
+func TestCloseStopsSweeper(t *testing.T) {
+	d := NewDht()
+	d.runPeriodically(time.Millisecond, func() { d.sweepExpired() })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			data := []byte{byte(i), byte(i >> 8)}
+			d.Data.Set(Hash(data), data, time.Now(), tReplicate)
+		}
+	}()
+	<-done
+
+	d.Close()
+	d.Close()
+
+	// All loops have exited once close returns
+	d.loops.Wait()
+}
@@ -9,12 +9,22 @@ const (
 	StoreMsg     MessageType = 2
 	FindNodeMsg  MessageType = 3
 	FindValueMsg MessageType = 4
+	LeaveMsg     MessageType = 5
 )
 
 // Recipient of this message responds back with pong,
 // which is same message format, except for setting
-// the Pong flag to true.
+// the Pong flag to true. Every response to a request
+// has the Response flag set, and carries the MsgId of
+// the request, which is used to match the two. A STORE
+// caching a value found by a lookup has the Cached flag
+// set, rather than storing an authoritative copy. Every
+// message carries the protocol version and capabilities
+// of its sender, and is signed with the private key of
+// the sender.
 type Message struct {
+	Version             uint16
+	Capabilities        Capabilities
 	Type                MessageType
 	MsgId               []byte
 	Sender              *Node
@@ -24,5 +34,8 @@ type Message struct {
 	Value               []byte
 	ExpirationTime      time.Time
 	Pong                bool
+	Response            bool
+	Cached              bool
 	KNearestNodes       []*Node
+	Signature           []byte
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 )
 
 // For this basic test, we should spin up a single dht, and
@@ -81,3 +82,99 @@ func TestPing(t *testing.T) {
 	dht2.Listener.Close()
 	<-dht2.Done
 }
+
+// Spin up n dhts, each serving connections until stopped
+func startDhts(n int, opts ...DhtOption) []*Dht {
+	dhts := make([]*Dht, n)
+	for i := range dhts {
+		dhts[i] = serveDht(NewDht(opts...))
+	}
+
+	return dhts
+}
+
+// Spin up n dhts on a new simulated network, each serving
+// connections until stopped
+func startSimDhts(n int, opts ...DhtOption) ([]*Dht, *SimNetwork) {
+	network := NewSimNetwork(1)
+	dhts := make([]*Dht, n)
+	for i := range dhts {
+		dhts[i] = serveDht(network.NewDht(opts...))
+	}
+
+	return dhts, network
+}
+
+// Serve connections to the dht until its listener is closed
+func serveDht(dht *Dht) *Dht {
+	go func() {
+		defer func() { dht.Done <- struct{}{} }()
+		dht.entry()
+	}()
+
+	return dht
+}
+
+// Close the listener of each dht, and wait for it to stop serving
+func stopDhts(dhts []*Dht) {
+	for _, dht := range dhts {
+		dht.Listener.Close()
+		<-dht.Done
+	}
+}
+
+// Seed the k buckets of each dht with only the dht before it,
+// so that nodes must be discovered through lookups
+func chainDhts(dhts []*Dht) {
+	for i := 1; i < len(dhts); i++ {
+		dhts[i].addToKBucket(dhts[i-1].Node)
+	}
+}
+
+// Poll the condition until it holds, failing the test if it
+// does not hold before the timeout passes
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition did not hold after %s", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Nodes joining through a single buddy node should learn of every
+// other node in the network, and the buddy node should learn of them
+func TestJoin(t *testing.T) {
+	dhts := startDhts(6)
+	defer stopDhts(dhts)
+
+	buddy := dhts[0]
+	for i, dht := range dhts[1:] {
+		learned, err := dht.join(buddy.Node.Addr, buddy.Node.Port)
+		if err != nil {
+			t.Fatalf("Error joining network, error: %s", err)
+		}
+
+		// Each node learns of all nodes which joined before it
+		if learned != i+1 {
+			t.Errorf("Node %d should learn %d contacts on joining, learned %d", i+1, i+1, learned)
+		}
+	}
+
+	if count := buddy.nodeCount(); count != len(dhts)-1 {
+		t.Errorf("Buddy node should know of %d nodes, knows of %d", len(dhts)-1, count)
+	}
+}
+
+// Joining through a node which is not listening should fail
+func TestJoinUnreachableBuddy(t *testing.T) {
+	dhts := startDhts(2)
+	stopDhts(dhts[1:])
+	defer stopDhts(dhts[:1])
+
+	if _, err := dhts[0].join(dhts[1].Node.Addr, dhts[1].Node.Port); err == nil {
+		t.Errorf("Joining through unreachable node should fail")
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"math/big"
 	"math/rand"
 	"net"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -15,9 +17,18 @@ const (
 )
 
 type Node struct {
-	Id   []byte
-	Addr net.IP
-	Port int
+	Id []byte
+	// Public key of the node, whose hash is the ID of the node
+	PublicKey ed25519.PublicKey
+	Addr      net.IP
+	Port      int
+	// Protocol version and capabilities the node advertises
+	Version      uint16
+	Capabilities Capabilities
+	// Difficulty of the crypto puzzles the node requires, and the
+	// nonce solving the dynamic puzzle for its ID
+	Difficulty PuzzleDifficulty
+	Nonce      []byte
 }
 
 // Use UDP dial to get preferred local IP address
@@ -35,21 +46,34 @@ func LookupLocalIP() (net.IP, error) {
 	return localAddr.IP, nil
 }
 
-// Instantiate new node, generate random ID and get local IP
+// Instantiate new node, with an ID derived from a freshly generated
+// key pair, discarding the private key of the node
 func NewNode() *Node {
-	// Set random seed for ID generation
+	node, _ := NewIdentity()
+	return node
+}
+
+// Instantiate new node, generating an Ed25519 key pair for the node,
+// whose ID is the hash of its public key. Returns the node, and the
+// private key which the node signs its messages with.
+func NewIdentity() (*Node, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(fmt.Sprintf("generating node key pair: %s", err))
+	}
+
+	// Set random seed for port selection
 	rand.Seed(time.Now().UnixNano())
 	node := &Node{
-		Id:   make([]byte, keysize),
-		Port: randomPort(),
+		Id:           nodeIdFor(publicKey),
+		PublicKey:    publicKey,
+		Addr:         net.ParseIP("127.0.0.1"),
+		Port:         randomPort(),
+		Version:      protocolVersion,
+		Capabilities: supportedCapabilities,
 	}
 
-	node.Addr = net.ParseIP("127.0.0.1")
-
-	// Generate random id.
-	rand.Read(node.Id)
-
-	return node
+	return node, privateKey
 }
 
 func randomPort() int {
@@ -80,3 +104,27 @@ func (n *Node) distance(other *Node) *big.Int {
 func (n *Node) equals(other *Node) bool {
 	return bytes.Compare(n.Id, other.Id) == 0 && n.Addr.Equal(other.Addr) && n.Port == other.Port
 }
+
+// Sort nodes in place by increasing distance to the given key. The
+// distance of each node is computed once up front, as lookups sort
+// large lists of contacts.
+func sortByDistance(nodes []*Node, key []byte) {
+	target := &Node{Id: key}
+	type entry struct {
+		node     *Node
+		distance *big.Int
+	}
+
+	entries := make([]entry, len(nodes))
+	for i, node := range nodes {
+		entries[i] = entry{node, node.distance(target)}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].distance.Cmp(entries[j].distance) < 0
+	})
+
+	for i := range entries {
+		nodes[i] = entries[i].node
+	}
+}
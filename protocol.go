@@ -0,0 +1,37 @@
+package main
+
+// Version of the protocol this node speaks, which is carried in every
+// message and in the contact info of every node. The version is bumped
+// for changes to the protocol which older nodes cannot follow, and the
+// minimum raised once nodes older than it are no longer talked to.
+// Messages and contacts from older versions are rejected, while newer
+// nodes are talked to, as they are responsible for downgrading to what
+// older nodes understand.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// Set of optional protocol features a node supports, which is carried
+// in every message and in the contact info of every node. Features are
+// only used with nodes which advertise them, so new features can be
+// rolled out while nodes without them remain in the network.
+type Capabilities uint32
+
+const (
+	// Handles LEAVE notifications from departing neighbors
+	CapLeave Capabilities = 1 << iota
+)
+
+// Capabilities of this node
+const supportedCapabilities = CapLeave
+
+// Whether every capability in other is in the set
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+// Whether we talk to nodes speaking the given protocol version
+func compatibleVersion(version uint16) bool {
+	return version >= minProtocolVersion
+}
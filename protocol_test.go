@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Messages from nodes older than the minimum protocol version should
+// be dropped, without the node being placed in the k-buckets
+func TestRejectsOlderProtocolVersion(t *testing.T) {
+	dhts, _ := startSimDhts(2, WithRPCTimeout(50*time.Millisecond))
+	defer stopDhts(dhts)
+	dhts[1].Node.Version = minProtocolVersion - 1
+
+	if err := dhts[1].pingNode(dhts[0].Node); err == nil {
+		t.Errorf("Ping from node of older protocol version should not be answered")
+	}
+
+	if knowsNode(dhts[0], dhts[1].Node) {
+		t.Errorf("Node of older protocol version should not be placed in k-buckets")
+	}
+}
+
+// Nodes of newer protocol versions should be talked to, as they are
+// responsible for downgrading to our version
+func TestAcceptsNewerProtocolVersion(t *testing.T) {
+	dhts, _ := startSimDhts(2)
+	defer stopDhts(dhts)
+	dhts[1].Node.Version = protocolVersion + 1
+	dhts[1].Node.Capabilities |= 1 << 31
+
+	if err := dhts[1].pingNode(dhts[0].Node); err != nil {
+		t.Fatalf("Error pinging from node of newer protocol version, error: %s", err)
+	}
+
+	if !knowsNode(dhts[0], dhts[1].Node) {
+		t.Errorf("Node of newer protocol version should be placed in k-buckets")
+	}
+}
+
+// Messages of types we do not know, as sent by nodes of newer protocol
+// versions, should be dropped without an answer, and without stopping
+// the node from serving
+func TestDropsUnknownMessageType(t *testing.T) {
+	dhts, _ := startSimDhts(2)
+	defer stopDhts(dhts)
+	dhts[1].Node.Version = protocolVersion + 1
+
+	msg := dhts[1].formPingMsg(false)
+	msg.Type = LeaveMsg + 1
+	if _, err := dhts[1].call(msg, dhts[0].Node, 50*time.Millisecond); err == nil {
+		t.Errorf("Message of unknown type should not be answered")
+	}
+
+	if err := dhts[1].pingNode(dhts[0].Node); err != nil {
+		t.Errorf("Node should keep serving after message of unknown type, error: %s", err)
+	}
+}
+
+// Requests for a key of other than the size of an ID should be dropped
+// without an answer, and without stopping the node from serving
+func TestDropsRequestsWithShortKey(t *testing.T) {
+	dhts, _ := startSimDhts(2)
+	defer stopDhts(dhts)
+
+	for _, msg := range []*Message{
+		dhts[1].formFindNodeMsg(nil),
+		dhts[1].formFindKeyMsg([]byte{1}),
+		dhts[1].formStoreKeyMsg(make([]byte, keysize-1), []byte("value")),
+	} {
+		if _, err := dhts[1].call(msg, dhts[0].Node, 50*time.Millisecond); err == nil {
+			t.Errorf("Request of type %d with key of %d bytes should not be answered", msg.Type, len(msg.Key))
+		}
+	}
+
+	if err := dhts[1].pingNode(dhts[0].Node); err != nil {
+		t.Errorf("Node should keep serving after requests with short keys, error: %s", err)
+	}
+}
+
+// Contacts of incompatible protocol versions learned from other nodes
+// should neither be placed in the k-buckets nor queried by lookups
+func TestIgnoresIncompatibleContacts(t *testing.T) {
+	d := NewDht()
+	defer d.Close()
+
+	old := NewNode()
+	old.Version = minProtocolVersion - 1
+	d.addToKBucket(old)
+	if count := d.nodeCount(); count != 0 {
+		t.Errorf("Node of incompatible protocol version should not be placed, node count %d", count)
+	}
+
+	list := newShortlist(old.Id, d.Node.Id, maxNodesInBucket)
+	list.add([]*Node{old, NewNode()})
+	if len(list.nodes) != 1 || list.nodes[0].equals(old) {
+		t.Errorf("Shortlist should only hold the compatible contact, got %d contacts", len(list.nodes))
+	}
+}
+
+// A leaving node should only notify neighbors which advertise that
+// they handle LEAVE notifications
+func TestLeaveSkipsNeighborsWithoutCapability(t *testing.T) {
+	dhts, _ := startSimDhts(3)
+	defer stopDhts(dhts)
+	dhts[2].Node.Capabilities &^= CapLeave
+	for _, dht := range dhts[1:] {
+		if _, err := dht.join(dhts[0].Node.Addr, dhts[0].Node.Port); err != nil {
+			t.Fatalf("Error joining network, error: %s", err)
+		}
+	}
+
+	d := dhts[0]
+	if notified := d.notifyNeighbors(context.Background()); notified != 1 {
+		t.Errorf("Expected 1 neighbor to be notified, got %d", notified)
+	}
+
+	waitFor(t, time.Second, func() bool { return !knowsNode(dhts[1], d.Node) })
+	if !knowsNode(dhts[2], d.Node) {
+		t.Errorf("Neighbor without LEAVE capability should not be notified")
+	}
+}
+
+func TestCapabilitiesHas(t *testing.T) {
+	caps := CapLeave | 1<<3
+	if !caps.Has(CapLeave) || !caps.Has(CapLeave|1<<3) || caps.Has(1<<4) || caps.Has(CapLeave|1<<4) {
+		t.Errorf("Capabilities %b reported wrong membership", caps)
+	}
+}
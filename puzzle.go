@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"math/bits"
+	"math/rand"
+)
+
+// Difficulty of the crypto puzzles node IDs must solve, as proposed by
+// S/Kademlia, each being the number of leading zero bits a hash must
+// have. The static puzzle makes picking an ID close to a chosen key
+// costly, as every attempt takes generating a key pair. The dynamic
+// puzzle makes each ID take work which can be raised as computers get
+// faster, without nodes replacing their key pairs. A difficulty of
+// zero skips the puzzle. Every node of a network must be configured
+// with the same difficulty, which is carried in the contact info of
+// every node.
+type PuzzleDifficulty struct {
+	Static  uint8 // leading zero bits of the hash of the node ID
+	Dynamic uint8 // leading zero bits of the hash of the node ID xored with the nonce of the node
+}
+
+// Highest difficulty either puzzle may be configured with. Each bit of
+// difficulty doubles the work of solving a puzzle, and the static
+// puzzle takes around 2^24 key pairs to solve at this limit.
+const maxPuzzleDifficulty = 24
+
+func (p PuzzleDifficulty) String() string {
+	return fmt.Sprintf("static %d, dynamic %d", p.Static, p.Dynamic)
+}
+
+// Require our ID and the IDs of our contacts to solve the crypto
+// puzzles at the given difficulty. If our key pair does not solve the
+// static puzzle, a new key pair which does is generated when the dht
+// is created. A key pair given with WithPrivateKey is never replaced,
+// and creating the dht panics if it does not solve the static puzzle.
+func WithPuzzleDifficulty(difficulty PuzzleDifficulty) DhtOption {
+	return func(d *Dht) {
+		d.Node.Difficulty = difficulty
+	}
+}
+
+// Number of leading zero bits of the data
+func leadingZeroBits(data []byte) int {
+	for i, b := range data {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+
+	return len(data) * 8
+}
+
+// Whether the ID solves the static puzzle at the given difficulty
+func solvesStaticPuzzle(id []byte, difficulty uint8) bool {
+	return leadingZeroBits(Hash(id)) >= int(difficulty)
+}
+
+// Whether the nonce solves the dynamic puzzle for the ID at the given
+// difficulty
+func solvesDynamicPuzzle(id []byte, nonce []byte, difficulty uint8) bool {
+	if difficulty == 0 {
+		return true
+	}
+	if len(nonce) != len(id) {
+		return false
+	}
+
+	xored := make([]byte, len(id))
+	for i := range id {
+		xored[i] = id[i] ^ nonce[i]
+	}
+
+	return leadingZeroBits(Hash(xored)) >= int(difficulty)
+}
+
+// Whether the node solves both puzzles at the given difficulty
+func (n *Node) solvesPuzzles(difficulty PuzzleDifficulty) bool {
+	return solvesStaticPuzzle(n.Id, difficulty.Static) && solvesDynamicPuzzle(n.Id, n.Nonce, difficulty.Dynamic)
+}
+
+// Generate a key pair whose ID solves the static puzzle at the given
+// difficulty, which takes 2^difficulty attempts on average
+func generatePuzzleKey(difficulty uint8) ed25519.PrivateKey {
+	for {
+		publicKey, privateKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			panic(fmt.Sprintf("generating node key pair: %s", err))
+		}
+
+		if solvesStaticPuzzle(nodeIdFor(publicKey), difficulty) {
+			return privateKey
+		}
+	}
+}
+
+// Find a nonce solving the dynamic puzzle for the ID at the given
+// difficulty, which takes 2^difficulty attempts on average. No nonce
+// is needed at a difficulty of zero.
+func solveDynamicPuzzle(id []byte, difficulty uint8) []byte {
+	if difficulty == 0 {
+		return nil
+	}
+
+	nonce := make([]byte, len(id))
+	rand.Read(nonce)
+	for !solvesDynamicPuzzle(id, nonce, difficulty) {
+		// Count up from the random start, carrying into the
+		// preceding bytes
+		for i := len(nonce) - 1; i >= 0; i-- {
+			nonce[i]++
+			if nonce[i] != 0 {
+				break
+			}
+		}
+	}
+
+	return nonce
+}
+
+// Solve the puzzles at our difficulty, replacing our key pair if its
+// ID does not solve the static puzzle, unless the key pair was given
+func (d *Dht) solvePuzzles() {
+	difficulty := d.Node.Difficulty
+	if !solvesStaticPuzzle(d.Node.Id, difficulty.Static) {
+		if d.keyGiven {
+			panic(fmt.Sprintf("given key pair does not solve static puzzle of difficulty %d", difficulty.Static))
+		}
+		writeLog("Generating key pair solving static puzzle of difficulty %d\n", difficulty.Static)
+		d.setPrivateKey(generatePuzzleKey(difficulty.Static))
+	}
+
+	d.Node.Nonce = solveDynamicPuzzle(d.Node.Id, difficulty.Dynamic)
+}
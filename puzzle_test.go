@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+var testDifficulty = PuzzleDifficulty{Static: 6, Dynamic: 6}
+
+func TestLeadingZeroBits(t *testing.T) {
+	cases := []struct {
+		data     []byte
+		expected int
+	}{
+		{[]byte{0x80}, 0},
+		{[]byte{0x01, 0xff}, 7},
+		{[]byte{0x00, 0x10}, 11},
+		{[]byte{0x00, 0x00}, 16},
+		{nil, 0},
+	}
+
+	for _, c := range cases {
+		if zeros := leadingZeroBits(c.data); zeros != c.expected {
+			t.Errorf("Expected %d leading zero bits in %x, got %d", c.expected, c.data, zeros)
+		}
+	}
+}
+
+// A node requiring puzzles should solve them itself, but refuse a key
+// pair it was given which does not solve the static puzzle
+func TestDhtSolvesOwnPuzzles(t *testing.T) {
+	d := NewDht(WithPuzzleDifficulty(testDifficulty))
+	defer d.Close()
+	if !d.Node.solvesPuzzles(testDifficulty) || !d.Node.hasValidId() {
+		t.Errorf("Node should solve the puzzles of its own difficulty")
+	}
+
+	solved := generatePuzzleKey(testDifficulty.Static)
+	given := NewDht(WithPrivateKey(solved), WithPuzzleDifficulty(testDifficulty))
+	defer given.Close()
+	if !bytes.Equal(given.Node.PublicKey, solved.Public().(ed25519.PublicKey)) || !given.Node.solvesPuzzles(testDifficulty) {
+		t.Errorf("Node given a key pair solving the static puzzle should keep it")
+	}
+
+	unsolved := generatePuzzleKey(0)
+	for solvesStaticPuzzle(nodeIdFor(unsolved.Public().(ed25519.PublicKey)), testDifficulty.Static) {
+		unsolved = generatePuzzleKey(0)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Node given a key pair not solving the static puzzle should refuse it")
+		}
+	}()
+	NewDht(WithPrivateKey(unsolved), WithPuzzleDifficulty(testDifficulty))
+}
+
+// Contacts should only be placed if they require the same difficulty
+// as we do, and their ID solves the puzzles at that difficulty
+func TestAddToKBucketChecksPuzzles(t *testing.T) {
+	d := NewDht(WithPuzzleDifficulty(testDifficulty))
+	defer d.Close()
+
+	solver := NewDht(WithPuzzleDifficulty(testDifficulty))
+	defer solver.Close()
+
+	unsolvedStatic := *solver.Node
+	unsolvedStatic.Id = NewNode().Id
+	for solvesStaticPuzzle(unsolvedStatic.Id, testDifficulty.Static) {
+		unsolvedStatic.Id = NewNode().Id
+	}
+
+	unsolvedDynamic := *solver.Node
+	unsolvedDynamic.Nonce = make([]byte, keysize)
+	for solvesDynamicPuzzle(unsolvedDynamic.Id, unsolvedDynamic.Nonce, testDifficulty.Dynamic) {
+		unsolvedDynamic.Nonce[0]++
+	}
+
+	otherDifficulty := *solver.Node
+	otherDifficulty.Difficulty = PuzzleDifficulty{}
+
+	for name, node := range map[string]*Node{
+		"static puzzle unsolved":  &unsolvedStatic,
+		"dynamic puzzle unsolved": &unsolvedDynamic,
+		"other difficulty":        &otherDifficulty,
+	} {
+		d.addToKBucket(node)
+		if knowsNode(d, node) {
+			t.Errorf("Node with %s should not be placed in k-buckets", name)
+		}
+	}
+
+	d.addToKBucket(solver.Node)
+	if !knowsNode(d, solver.Node) {
+		t.Errorf("Node solving the puzzles should be placed in k-buckets")
+	}
+}
+
+// Nodes should only join through a buddy requiring the same puzzle
+// difficulty, with neither placing the other otherwise
+func TestJoinChecksPuzzleDifficulty(t *testing.T) {
+	network := NewSimNetwork(1)
+	buddy := serveDht(network.NewDht(WithPuzzleDifficulty(testDifficulty)))
+	same := serveDht(network.NewDht(WithPuzzleDifficulty(testDifficulty)))
+	other := serveDht(network.NewDht())
+	defer stopDhts([]*Dht{buddy, same, other})
+
+	if _, err := other.join(buddy.Node.Addr, buddy.Node.Port); err == nil {
+		t.Errorf("Joining through buddy of other puzzle difficulty should fail")
+	}
+
+	if knowsNode(buddy, other.Node) || knowsNode(other, buddy.Node) {
+		t.Errorf("Nodes of different puzzle difficulty should not place each other in k-buckets")
+	}
+
+	if _, err := same.join(buddy.Node.Addr, buddy.Node.Port); err != nil {
+		t.Fatalf("Error joining through buddy of same puzzle difficulty, error: %s", err)
+	}
+
+	if !knowsNode(buddy, same.Node) || !knowsNode(same, buddy.Node) {
+		t.Errorf("Nodes of same puzzle difficulty should place each other in k-buckets")
+	}
+}
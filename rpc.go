@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Table of requests sent by this node which are still waiting on
+// a response, keyed by the MsgId of the request. Each entry holds
+// the channel which the matching response is delivered on, and the
+// ID of the node the response must come from, if known.
+type pendingRequests struct {
+	mtx      sync.Mutex
+	requests map[string]*pendingRequest
+}
+
+type pendingRequest struct {
+	ch     chan *Message
+	nodeId []byte
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{requests: make(map[string]*pendingRequest)}
+}
+
+// Register a request to the node with the given ID as waiting on a
+// response, returning the channel which the response will be delivered
+// on. With a nil ID, a response from any node is delivered.
+func (p *pendingRequests) add(msgId []byte, nodeId []byte) chan *Message {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	ch := make(chan *Message, 1)
+	p.requests[string(msgId)] = &pendingRequest{ch: ch, nodeId: nodeId}
+	return ch
+}
+
+// Stop waiting on a response for the request
+func (p *pendingRequests) remove(msgId []byte) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.requests, string(msgId))
+}
+
+// Deliver a response to the request waiting on it, returning false if
+// no request is waiting, which is the case for unmatched responses and
+// for responses which arrive after the request has timed out. Responses
+// from nodes other than the one the request was sent to are not
+// delivered, and the request keeps waiting on the real response.
+func (p *pendingRequests) deliver(resp *Message) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	req, ok := p.requests[string(resp.MsgId)]
+	if !ok {
+		return false
+	}
+
+	if req.nodeId != nil && (resp.Sender == nil || !bytes.Equal(resp.Sender.Id, req.nodeId)) {
+		return false
+	}
+
+	delete(p.requests, string(resp.MsgId))
+	req.ch <- resp
+	return true
+}
+
+// Wait for the given time for other nodes to respond to requests,
+// rather than the default tRpcTimeout
+func WithRPCTimeout(timeout time.Duration) DhtOption {
+	return func(d *Dht) {
+		d.rpcTimeout = timeout
+	}
+}
+
+// Send a request to the node, and block until the response with the
+// matching MsgId arrives, or until the timeout passes. If we know the
+// ID of the node, only a response from the node with that ID is taken.
+func (d *Dht) call(msg *Message, node *Node, timeout time.Duration) (*Message, error) {
+	ch := d.pending.add(msg.MsgId, node.Id)
+	defer d.pending.remove(msg.MsgId)
+
+	if err := d.sendMessageToNode(msg, node); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-time.After(timeout):
+		writeLog("Request %v to %s timed out\n", msg.MsgId, node.AddressString())
+		return nil, fmt.Errorf("request %v to %s timed out after %s", msg.MsgId, node.AddressString(), timeout)
+	}
+}
+
+// Handle a response from another node, which is placed in the
+// k-buckets, and dropped if no request is waiting on the response
+func (d *Dht) handleResponse(resp *Message) {
+	d.addToKBucket(resp.Sender)
+
+	if !d.pending.deliver(resp) {
+		writeLog("Dropping unmatched response %v\n", resp.MsgId)
+	}
+}
+
+// Ping the node, returning an error if it does not respond with a pong
+func (d *Dht) pingNode(node *Node) error {
+	_, err := d.call(d.formPingMsg(false), node, d.rpcTimeout)
+	return err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// A call should block until the response with the matching
+// MsgId arrives from the node which was sent the request
+func TestCallMatchesResponse(t *testing.T) {
+	dhts := startDhts(2)
+	defer stopDhts(dhts)
+
+	req := dhts[1].formPingMsg(false)
+	resp, err := dhts[1].call(req, dhts[0].Node, tRpcTimeout)
+	if err != nil {
+		t.Fatalf("Error calling node %s, error: %s", dhts[0].Node.AddressString(), err)
+	}
+
+	if !bytes.Equal(resp.MsgId, req.MsgId) {
+		t.Errorf("Response MsgId should be %v, got %v", req.MsgId, resp.MsgId)
+	}
+
+	if !resp.Pong || !resp.Response || !resp.Sender.equals(dhts[0].Node) {
+		t.Errorf("Expected pong response from %v, got %+v", dhts[0].Node.Id, resp)
+	}
+
+	if res := dhts[1].nodeCount(); res != 1 {
+		t.Errorf("Node count for caller should be 1, was %d", res)
+	}
+}
+
+// A call to a node which never responds should time out, and a
+// response arriving after the timeout should be dropped
+func TestCallTimesOut(t *testing.T) {
+	dhts := startDhts(1)
+	defer stopDhts(dhts)
+
+	// Accept connections without ever responding to requests
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening, error: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+
+	silent := NewNode()
+	silent.Port = listener.Addr().(*net.TCPAddr).Port
+
+	req := dhts[0].formPingMsg(false)
+	start := time.Now()
+	if _, err := dhts[0].call(req, silent, 100*time.Millisecond); err == nil {
+		t.Fatalf("Call to silent node should time out")
+	}
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Call should wait for the timeout, returned after %s", elapsed)
+	}
+
+	late := &Message{Type: PingMsg, MsgId: req.MsgId, Sender: silent, Pong: true, Response: true}
+	if dhts[0].pending.deliver(late) {
+		t.Errorf("Late response should not be delivered")
+	}
+}
+
+// Responses which match no request should be dropped
+func TestUnmatchedResponseDropped(t *testing.T) {
+	pending := newPendingRequests()
+	req := &Message{Type: PingMsg, MsgId: GenerateMsgId()}
+	ch := pending.add(req.MsgId, nil)
+
+	unmatched := &Message{Type: PingMsg, MsgId: GenerateMsgId(), Response: true}
+	if pending.deliver(unmatched) {
+		t.Errorf("Unmatched response should not be delivered")
+	}
+
+	matched := &Message{Type: PingMsg, MsgId: req.MsgId, Response: true}
+	if !pending.deliver(matched) {
+		t.Fatalf("Matching response should be delivered")
+	}
+
+	if resp := <-ch; resp != matched {
+		t.Errorf("Expected matching response to be delivered, got %+v", resp)
+	}
+
+	// Only the first response to a request is delivered
+	if pending.deliver(matched) {
+		t.Errorf("Duplicate response should not be delivered")
+	}
+}
+
+// Responses from nodes other than the one a request was sent to should
+// not be delivered, leaving the request waiting on the real response
+func TestResponseFromOtherNodeNotDelivered(t *testing.T) {
+	pending := newPendingRequests()
+	node, other := NewNode(), NewNode()
+	req := &Message{Type: PingMsg, MsgId: GenerateMsgId()}
+	ch := pending.add(req.MsgId, node.Id)
+
+	forged := &Message{Type: PingMsg, MsgId: req.MsgId, Sender: other, Response: true}
+	if pending.deliver(forged) {
+		t.Errorf("Response from another node should not be delivered")
+	}
+
+	genuine := &Message{Type: PingMsg, MsgId: req.MsgId, Sender: node, Response: true}
+	if !pending.deliver(genuine) {
+		t.Fatalf("Response from the node the request was sent to should be delivered")
+	}
+
+	if resp := <-ch; resp != genuine {
+		t.Errorf("Expected response from %v to be delivered, got %+v", node.Id, resp)
+	}
+}
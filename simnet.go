@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Simulated network connecting in-memory transports within a single
+// process, in place of real sockets. Nodes on the network are addressed
+// by port alone. Messages can be delayed by a fixed latency, dropped at
+// random with a given loss rate, and dropped between pairs of nodes
+// which are partitioned from one another. Loss is decided by a random
+// source seeded when the network is created, so a run is reproducible.
+type SimNetwork struct {
+	mtx        sync.Mutex
+	listeners  map[int]*simListener
+	partitions map[[2]int]bool
+	latency    time.Duration
+	lossRate   float64
+	random     *rand.Rand
+	nextPort   int
+}
+
+// First port assigned to nodes created on a simulated network
+const simFirstPort = 10000
+
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		listeners:  make(map[int]*simListener),
+		partitions: make(map[[2]int]bool),
+		random:     rand.New(rand.NewSource(seed)),
+		nextPort:   simFirstPort,
+	}
+}
+
+// Create a dht on the network, listening on the next free port
+func (n *SimNetwork) NewDht(opts ...DhtOption) *Dht {
+	n.mtx.Lock()
+	port := n.nextPort
+	n.nextPort++
+	n.mtx.Unlock()
+
+	return NewDht(append([]DhtOption{WithTransport(n.Transport()), WithPort(port)}, opts...)...)
+}
+
+// Get a transport which sends and receives over the network
+func (n *SimNetwork) Transport() Transport {
+	return &simTransport{network: n}
+}
+
+// Delay every message by the given latency
+func (n *SimNetwork) SetLatency(latency time.Duration) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.latency = latency
+}
+
+// Drop each message with the given probability
+func (n *SimNetwork) SetLossRate(lossRate float64) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.lossRate = lossRate
+}
+
+// Drop all messages between the two nodes, in both directions
+func (n *SimNetwork) Partition(a *Node, b *Node) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.partitions[simLink(a.Port, b.Port)] = true
+}
+
+// Deliver messages between the two nodes again
+func (n *SimNetwork) Heal(a *Node, b *Node) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	delete(n.partitions, simLink(a.Port, b.Port))
+}
+
+func simLink(a int, b int) [2]int {
+	if a > b {
+		a, b = b, a
+	}
+
+	return [2]int{a, b}
+}
+
+// Decide whether a message from one port to another is dropped
+func (n *SimNetwork) dropped(from int, to int) bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.partitions[simLink(from, to)] {
+		return true
+	}
+
+	return n.lossRate > 0 && n.random.Float64() < n.lossRate
+}
+
+// Deliver a message to the node listening on the port, after the
+// latency of the network, unless the message is dropped on the way
+func (n *SimNetwork) send(from int, to int, data []byte) error {
+	n.mtx.Lock()
+	listener, ok := n.listeners[to]
+	latency := n.latency
+	n.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("connection refused by port %d", to)
+	}
+
+	if n.dropped(from, to) {
+		return nil
+	}
+
+	conn := &receivedDatagram{
+		Reader: bytes.NewReader(data),
+		local:  simAddr(to),
+		remote: simAddr(from),
+	}
+	if latency == 0 {
+		listener.deliver(conn)
+	} else {
+		time.AfterFunc(latency, func() { listener.deliver(conn) })
+	}
+
+	return nil
+}
+
+// Address of a node on a simulated network
+type simAddr int
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(a))) }
+
+// Transport over a simulated network. The port it listens on is the
+// source of the messages it sends, so that partitions apply to them.
+type simTransport struct {
+	network *SimNetwork
+	port    int
+}
+
+func (t *simTransport) Listen(port int) (net.Listener, error) {
+	t.network.mtx.Lock()
+	defer t.network.mtx.Unlock()
+	if _, ok := t.network.listeners[port]; ok {
+		return nil, fmt.Errorf("port %d already in use", port)
+	}
+
+	listener := &simListener{
+		network: t.network,
+		port:    port,
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	t.network.listeners[port] = listener
+	t.port = port
+	return listener, nil
+}
+
+func (t *simTransport) Dial(addr string) (net.Conn, error) {
+	_, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+
+	return &simConn{transport: t, to: port}, nil
+}
+
+// Listener accepting the messages delivered to a port as connections
+type simListener struct {
+	network   *SimNetwork
+	port      int
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Hand a delivered message to the listener, unless it has closed
+func (l *simListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+	}
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *simListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.mtx.Lock()
+		delete(l.network.listeners, l.port)
+		l.network.mtx.Unlock()
+		close(l.done)
+	})
+
+	return nil
+}
+
+func (l *simListener) Addr() net.Addr {
+	return simAddr(l.port)
+}
+
+// Connection dialed over a simulated network, which buffers everything
+// written to it, and sends it as a single message on closing
+type simConn struct {
+	transport *simTransport
+	to        int
+	buf       bytes.Buffer
+}
+
+func (c *simConn) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (c *simConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+
+func (c *simConn) Close() error {
+	return c.transport.network.send(c.transport.port, c.to, c.buf.Bytes())
+}
+
+func (c *simConn) LocalAddr() net.Addr                { return simAddr(c.transport.port) }
+func (c *simConn) RemoteAddr() net.Addr               { return simAddr(c.to) }
+func (c *simConn) SetDeadline(t time.Time) error      { return nil }
+func (c *simConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *simConn) SetWriteDeadline(t time.Time) error { return nil }
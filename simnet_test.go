@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Messages on a simulated network should be delayed by its latency,
+// so that a ping takes at least a round trip
+func TestSimNetworkLatency(t *testing.T) {
+	dhts, network := startSimDhts(2)
+	defer stopDhts(dhts)
+	network.SetLatency(20 * time.Millisecond)
+
+	start := time.Now()
+	if err := dhts[1].pingNode(dhts[0].Node); err != nil {
+		t.Fatalf("Error pinging node, error: %s", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Ping should take at least a round trip of 40ms, took %s", elapsed)
+	}
+}
+
+// Messages between partitioned nodes should be dropped, while other
+// nodes can still reach both of them, until the partition heals
+func TestSimNetworkPartition(t *testing.T) {
+	dhts, network := startSimDhts(3, WithRPCTimeout(20*time.Millisecond))
+	defer stopDhts(dhts)
+
+	network.Partition(dhts[0].Node, dhts[1].Node)
+	if err := dhts[1].pingNode(dhts[0].Node); err == nil {
+		t.Errorf("Ping across partition should fail")
+	}
+
+	if err := dhts[0].pingNode(dhts[1].Node); err == nil {
+		t.Errorf("Ping across partition should fail in both directions")
+	}
+
+	for _, dht := range dhts[:2] {
+		if err := dhts[2].pingNode(dht.Node); err != nil {
+			t.Errorf("Ping to node outside partition should succeed, error: %s", err)
+		}
+	}
+
+	network.Heal(dhts[0].Node, dhts[1].Node)
+	if err := dhts[1].pingNode(dhts[0].Node); err != nil {
+		t.Errorf("Ping after healing partition should succeed, error: %s", err)
+	}
+}
+
+// A lookup should route around a node which is partitioned from the
+// node performing the lookup
+func TestLookupAroundPartition(t *testing.T) {
+	dhts, network := startSimDhts(8, WithRPCTimeout(20*time.Millisecond))
+	defer stopDhts(dhts)
+	for _, dht := range dhts[1:] {
+		if _, err := dht.join(dhts[0].Node.Addr, dhts[0].Node.Port); err != nil {
+			t.Fatalf("Error joining network, error: %s", err)
+		}
+	}
+
+	last := dhts[len(dhts)-1]
+	network.Partition(last.Node, dhts[1].Node)
+
+	result := last.LookupNode(dhts[1].Node.Id)
+	if len(result) != len(dhts)-2 {
+		t.Errorf("Lookup should return the %d reachable nodes, got %d", len(dhts)-2, len(result))
+	}
+
+	for _, node := range result {
+		if node.equals(dhts[1].Node) {
+			t.Errorf("Partitioned node should not be returned by lookup")
+		}
+	}
+}
+
+// Loss on a simulated network should be decided by its seed, and
+// should drop roughly the configured fraction of messages
+func TestSimNetworkLossIsDeterministic(t *testing.T) {
+	drops := func(seed int64) []bool {
+		network := NewSimNetwork(seed)
+		network.SetLossRate(0.5)
+
+		var result []bool
+		for i := 0; i < 1000; i++ {
+			result = append(result, network.dropped(simFirstPort, simFirstPort+1))
+		}
+		return result
+	}
+
+	first, second := drops(7), drops(7)
+	dropped := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Networks with the same seed should drop the same messages")
+		}
+		if first[i] {
+			dropped++
+		}
+	}
+
+	if dropped < 400 || dropped > 600 {
+		t.Errorf("Expected about half of messages to be dropped, dropped %d of %d", dropped, len(first))
+	}
+}
+
+// Messages to a port no node listens on should fail immediately
+func TestSimNetworkUnreachable(t *testing.T) {
+	dhts, _ := startSimDhts(1)
+	defer stopDhts(dhts)
+
+	if err := dhts[0].pingNode(&Node{Addr: dhts[0].Node.Addr, Port: 1}); err == nil {
+		t.Errorf("Ping to port without listener should fail")
+	}
+}
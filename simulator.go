@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parameters of a lookup simulation, which builds a network of nodes
+// over a simulated network, and measures lookups performed on it
+type SimulationConfig struct {
+	Nodes       int     // the number of nodes joining the network
+	Lookups     int     // the number of lookups of each kind measured
+	K           int     // the bucket size used by every node
+	Alpha       int     // the lookup parallelism used by every node
+	Paths       int     // the number of disjoint paths each lookup is split over, by every node
+	Adversarial float64 // the fraction of nodes which collude to mislead lookups
+	Seed        int64   // the seed deciding who joins through whom, who is adversarial, and who looks up what
+}
+
+// Measurements of one kind of lookup over a simulation
+type LookupStats struct {
+	Lookups   int // the number of lookups performed
+	Succeeded int // the number of lookups which found what they looked for
+	Misled    int // the number of lookups which found something else in its place
+	Disagreed int // the number of disjoint lookups whose paths disagreed
+	Hops      int // the rounds of requests sent, over all lookups
+	Messages  int // the requests sent, over all lookups
+}
+
+func (s *LookupStats) add(result *lookupResult, succeeded bool, misled bool) {
+	s.Lookups++
+	s.Hops += result.hops
+	s.Messages += result.messages
+	if succeeded {
+		s.Succeeded++
+	}
+	if misled {
+		s.Misled++
+	}
+	if result.disagreed {
+		s.Disagreed++
+	}
+}
+
+// Add the measurements of other lookups to these
+func (s *LookupStats) merge(other LookupStats) {
+	s.Lookups += other.Lookups
+	s.Succeeded += other.Succeeded
+	s.Misled += other.Misled
+	s.Disagreed += other.Disagreed
+	s.Hops += other.Hops
+	s.Messages += other.Messages
+}
+
+func (s LookupStats) SuccessRate() float64 {
+	return s.mean(s.Succeeded)
+}
+
+func (s LookupStats) MisledRate() float64 {
+	return s.mean(s.Misled)
+}
+
+func (s LookupStats) MeanHops() float64 {
+	return s.mean(s.Hops)
+}
+
+func (s LookupStats) MeanMessages() float64 {
+	return s.mean(s.Messages)
+}
+
+func (s LookupStats) mean(total int) float64 {
+	if s.Lookups == 0 {
+		return 0
+	}
+
+	return float64(total) / float64(s.Lookups)
+}
+
+// Results of a lookup simulation. A FIND_NODE lookup succeeds if it
+// locates the node closest to a random target, and a FIND_VALUE lookup
+// succeeds if it retrieves the value stored under a key. Lookups which
+// return another node or value in their place were misled, while those
+// returning nothing, such as disjoint lookups whose paths disagreed,
+// neither succeeded nor were misled.
+type SimulationReport struct {
+	Config    SimulationConfig
+	FindNode  LookupStats
+	FindValue LookupStats
+	Elapsed   time.Duration
+}
+
+func (r *SimulationReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "nodes=%d k=%d alpha=%d paths=%d adversarial=%.1f%% lookups=%d (%s)\n",
+		r.Config.Nodes, r.Config.K, r.Config.Alpha, r.Config.Paths, 100*r.Config.Adversarial, r.Config.Lookups,
+		r.Elapsed.Round(time.Millisecond))
+	for _, row := range []struct {
+		name  string
+		stats LookupStats
+	}{{"FIND_NODE", r.FindNode}, {"FIND_VALUE", r.FindValue}} {
+		fmt.Fprintf(&b, "  %-10s success=%6.2f%% misled=%6.2f%% disagreed=%4d hops=%5.2f messages=%6.2f\n",
+			row.name, 100*row.stats.SuccessRate(), 100*row.stats.MisledRate(), row.stats.Disagreed,
+			row.stats.MeanHops(), row.stats.MeanMessages())
+	}
+
+	return b.String()
+}
+
+// Run a lookup simulation. Nodes join the network one at a time, each
+// through a random node which joined before it. A value is then put
+// from a random node for each lookup, after which random nodes look up
+// random targets and the stored keys. Value lookups are sent from nodes
+// which do not hold the value, and do not cache the value they find,
+// so that each lookup sees the network as it was built. Once the network
+// is built, the adversarial fraction of nodes turn on the others, by
+// having their transport rewrite the lookup responses they send, and
+// lookups are only sent from the honest nodes.
+func RunSimulation(config SimulationConfig) (*SimulationReport, error) {
+	if config.Nodes < 2 {
+		return nil, fmt.Errorf("simulation needs at least 2 nodes, got %d", config.Nodes)
+	}
+	if config.Paths < 1 {
+		config.Paths = 1
+	}
+
+	start := time.Now()
+	random := rand.New(rand.NewSource(config.Seed))
+	network := NewSimNetwork(config.Seed)
+
+	dhts := make([]*Dht, config.Nodes)
+	transports := make([]*adversarialTransport, config.Nodes)
+	defer func() {
+		for _, dht := range dhts {
+			if dht != nil {
+				dht.Close()
+				<-dht.Done
+			}
+		}
+	}()
+
+	for i := range dhts {
+		_, privateKey := NewIdentity()
+		transports[i] = &adversarialTransport{Transport: network.Transport(), privateKey: privateKey}
+		dhts[i] = network.NewDht(WithTransport(transports[i]), WithPrivateKey(privateKey),
+			WithBucketSize(config.K), WithAlpha(config.Alpha), WithDisjointPaths(config.Paths))
+		go func(dht *Dht) {
+			defer func() { dht.Done <- struct{}{} }()
+			dht.entry()
+		}(dhts[i])
+
+		if i == 0 {
+			continue
+		}
+
+		buddy := dhts[random.Intn(i)].Node
+		if _, err := dhts[i].join(buddy.Addr, buddy.Port); err != nil {
+			return nil, fmt.Errorf("node %d failed to join the network, error: %s", i, err)
+		}
+	}
+
+	honest := turnAdversarial(dhts, transports, config.Adversarial, random)
+
+	report := &SimulationReport{Config: config}
+	for i := 0; i < config.Lookups; i++ {
+		source := honest[random.Intn(len(honest))]
+		target := make([]byte, keysize)
+		random.Read(target)
+
+		result := source.iterativeLookup(target, false)
+		closest := closestNode(dhts, target, source.Node)
+		found := len(result.closest) > 0
+		report.FindNode.add(result, found && result.closest[0].equals(closest), found && !result.closest[0].equals(closest))
+	}
+
+	values := make([][]byte, config.Lookups)
+	for i := range values {
+		values[i] = []byte("simulated value " + strconv.Itoa(i))
+		if _, _, err := honest[random.Intn(len(honest))].Put(values[i]); err != nil {
+			return nil, fmt.Errorf("failed to store value %d, error: %s", i, err)
+		}
+	}
+
+	for _, value := range values {
+		key := Hash(value)
+		var sources []*Dht
+		for _, dht := range honest {
+			if _, err := dht.Data.Get(key); err != nil {
+				sources = append(sources, dht)
+			}
+		}
+		if len(sources) == 0 {
+			sources = honest
+		}
+
+		result := sources[random.Intn(len(sources))].iterativeLookup(key, true)
+		report.FindValue.add(result, bytes.Equal(result.value, value), result.value != nil && !bytes.Equal(result.value, value))
+	}
+
+	report.Elapsed = time.Since(start)
+	return report, nil
+}
+
+// Turn the given fraction of the nodes adversarial, other than the
+// first node, through the transports the nodes were created with.
+// Returns the nodes which remain honest.
+func turnAdversarial(dhts []*Dht, transports []*adversarialTransport, fraction float64, random *rand.Rand) []*Dht {
+	count := int(fraction * float64(len(dhts)))
+	if count > len(dhts)-1 {
+		count = len(dhts) - 1
+	}
+
+	colluders := &adversary{k: dhts[0].k}
+	turned := make(map[int]bool)
+	for _, i := range random.Perm(len(dhts) - 1)[:count] {
+		turned[i+1] = true
+		colluders.nodes = append(colluders.nodes, dhts[i+1].Node)
+	}
+
+	var honest []*Dht
+	for i, dht := range dhts {
+		if turned[i] {
+			transports[i].turn(colluders)
+		} else {
+			honest = append(honest, dht)
+		}
+	}
+
+	return honest
+}
+
+// Colluding nodes in a simulation, which answer lookup requests so as
+// to mislead the lookups of honest nodes. Contacts are answered with
+// the colluders closest to the target, in place of the contacts in the
+// k-buckets, so that lookups are led among the colluders. Values are
+// answered with a forgery every colluder agrees on.
+type adversary struct {
+	nodes []*Node
+	k     int
+}
+
+// Rewrite the response of a colluder to a lookup request
+func (a *adversary) mislead(resp *Message) {
+	if resp.Type == FindValueMsg {
+		resp.Value = append([]byte("forged value for "), resp.Key...)
+		resp.KNearestNodes = nil
+		return
+	}
+
+	closest := append([]*Node{}, a.nodes...)
+	sortByDistance(closest, resp.Key)
+	if len(closest) > a.k {
+		closest = closest[:a.k]
+	}
+	resp.KNearestNodes = closest
+}
+
+// Transport of a node in a simulation, which once the node is turned
+// rewrites the lookup responses it sends, re-signing them with the key
+// pair of the node. The node itself serves every request honestly, and
+// is unaware of being turned. Nodes of a simulation send messages with
+// the binary codec.
+type adversarialTransport struct {
+	Transport
+	privateKey ed25519.PrivateKey
+	mtx        sync.Mutex
+	colluders  *adversary
+}
+
+// Have the node collude with the given nodes from now on
+func (t *adversarialTransport) turn(colluders *adversary) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.colluders = colluders
+}
+
+func (t *adversarialTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mtx.Lock()
+	colluders := t.colluders
+	t.mtx.Unlock()
+	if colluders == nil {
+		return conn, nil
+	}
+
+	return &misleadingConn{Conn: conn, colluders: colluders, privateKey: t.privateKey}, nil
+}
+
+// Connection dialed by a turned node, which buffers the message written
+// to it, and rewrites it on closing if it is a lookup response
+type misleadingConn struct {
+	net.Conn
+	colluders  *adversary
+	privateKey ed25519.PrivateKey
+	buf        bytes.Buffer
+}
+
+func (c *misleadingConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+
+func (c *misleadingConn) Close() error {
+	data := c.buf.Bytes()
+	msg, err := BinaryCodec{}.Decode(bytes.NewReader(data))
+	if err == nil && msg.Response && (msg.Type == FindNodeMsg || msg.Type == FindValueMsg) {
+		c.colluders.mislead(msg)
+		msg.Signature = ed25519.Sign(c.privateKey, msg.signedBytes())
+
+		var rewritten bytes.Buffer
+		if err := (BinaryCodec{}).Encode(&rewritten, msg); err == nil {
+			data = rewritten.Bytes()
+		}
+	}
+
+	if _, err := c.Conn.Write(data); err != nil {
+		c.Conn.Close()
+		return err
+	}
+
+	return c.Conn.Close()
+}
+
+// Find the node closest to the target among all nodes in the
+// simulation, other than the node looking it up
+func closestNode(dhts []*Dht, target []byte, exclude *Node) *Node {
+	var nodes []*Node
+	for _, dht := range dhts {
+		if !dht.Node.equals(exclude) {
+			nodes = append(nodes, dht.Node)
+		}
+	}
+
+	sortByDistance(nodes, target)
+	return nodes[0]
+}
+
+// Run a lookup simulation for each combination of the given bucket
+// sizes, lookup parallelism and disjoint paths, printing the report
+// of each
+func runSimulations(config SimulationConfig, ks []int, alphas []int, paths []int) error {
+	for _, k := range ks {
+		for _, parallelism := range alphas {
+			for _, disjoint := range paths {
+				config.K, config.Alpha, config.Paths = k, parallelism, disjoint
+				report, err := RunSimulation(config)
+				if err != nil {
+					return err
+				}
+
+				fmt.Print(report)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Parse a comma separated list of positive integers
+func parseIntList(list string) ([]int, error) {
+	var result []int
+	for _, field := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("expected a positive integer, got %d", n)
+		}
+
+		result = append(result, n)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Lookups in a small simulated network should all succeed, and report
+// the hops and messages they took
+func TestRunSimulation(t *testing.T) {
+	for _, test := range []struct {
+		k     int
+		alpha int
+	}{
+		{k: 4, alpha: 1},
+		{k: 8, alpha: 3},
+	} {
+		report, err := RunSimulation(SimulationConfig{Nodes: 30, Lookups: 10, K: test.k, Alpha: test.alpha, Seed: 1})
+		if err != nil {
+			t.Fatalf("Error running simulation with k=%d alpha=%d, error: %s", test.k, test.alpha, err)
+		}
+
+		for name, stats := range map[string]LookupStats{"FIND_NODE": report.FindNode, "FIND_VALUE": report.FindValue} {
+			if stats.Lookups != 10 || stats.SuccessRate() != 1 {
+				t.Errorf("Expected all 10 %s lookups to succeed with k=%d alpha=%d, %d of %d succeeded",
+					name, test.k, test.alpha, stats.Succeeded, stats.Lookups)
+			}
+
+			if stats.MeanHops() < 1 || stats.MeanMessages() < stats.MeanHops() {
+				t.Errorf("Expected at least one hop and one message per hop for %s, got %.2f hops and %.2f messages",
+					name, stats.MeanHops(), stats.MeanMessages())
+			}
+
+			if stats.MeanMessages() > float64(test.alpha)*stats.MeanHops() {
+				t.Errorf("Expected at most alpha=%d messages per hop for %s, got %.2f hops and %.2f messages",
+					test.alpha, name, stats.MeanHops(), stats.MeanMessages())
+			}
+		}
+	}
+}
+
+// Colluding nodes should mislead lookups over a single path with
+// forged values, and lookups should only be sent from honest nodes
+func TestRunSimulationWithAdversaries(t *testing.T) {
+	report, err := RunSimulation(SimulationConfig{Nodes: 40, Lookups: 20, K: 8, Alpha: 3, Adversarial: 0.3, Seed: 1})
+	if err != nil {
+		t.Fatalf("Error running simulation, error: %s", err)
+	}
+
+	if report.FindValue.Misled == 0 {
+		t.Errorf("Expected adversarial nodes to mislead some value lookups")
+	}
+
+	if report.FindNode.Lookups != 20 || report.FindValue.Lookups != 20 {
+		t.Errorf("Expected 20 lookups of each kind, got %d and %d", report.FindNode.Lookups, report.FindValue.Lookups)
+	}
+}
+
+func TestRunSimulationNeedsNodes(t *testing.T) {
+	if _, err := RunSimulation(SimulationConfig{Nodes: 1, Lookups: 1, K: 20, Alpha: 3}); err == nil {
+		t.Errorf("Simulation with a single node should fail")
+	}
+}
+
+func TestParseIntList(t *testing.T) {
+	result, err := parseIntList("5, 10,20")
+	if err != nil || len(result) != 3 || result[0] != 5 || result[1] != 10 || result[2] != 20 {
+		t.Errorf("Expected [5 10 20], got %v with error %v", result, err)
+	}
+
+	for _, list := range []string{"", "5,x", "0", "3,-1"} {
+		if _, err := parseIntList(list); err == nil {
+			t.Errorf("Expected error parsing %q", list)
+		}
+	}
+}
+
+// Measure how disjoint paths hold up against colluding nodes, which
+// make up a tenth of the network. Each iteration runs a simulation,
+// and reports the rates at which lookups succeed and are misled.
+func BenchmarkDisjointLookupsUnderAttack(b *testing.B) {
+	for _, paths := range []int{1, 2, 3, 4} {
+		b.Run(fmt.Sprintf("paths=%d", paths), func(b *testing.B) {
+			var findNode, findValue LookupStats
+			for i := 0; i < b.N; i++ {
+				report, err := RunSimulation(SimulationConfig{
+					Nodes:       100,
+					Lookups:     50,
+					K:           8,
+					Alpha:       3,
+					Paths:       paths,
+					Adversarial: 0.1,
+					Seed:        int64(i + 1),
+				})
+				if err != nil {
+					b.Fatalf("Error running simulation, error: %s", err)
+				}
+
+				findNode.merge(report.FindNode)
+				findValue.merge(report.FindValue)
+			}
+
+			b.ReportMetric(100*findNode.SuccessRate(), "node-success-%")
+			b.ReportMetric(100*findNode.MisledRate(), "node-misled-%")
+			b.ReportMetric(100*findValue.SuccessRate(), "value-success-%")
+			b.ReportMetric(100*findValue.MisledRate(), "value-misled-%")
+			b.ReportMetric(findValue.MeanMessages(), "value-messages/lookup")
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Store the value in the network, under the key given by the hash of
+// the value. Returns the key, and the number of nodes which accepted
+// the value.
+func (d *Dht) Put(value []byte) ([]byte, int, error) {
+	key := Hash(value)
+	stored, err := d.PutKey(key, value)
+	return key, stored, err
+}
+
+// Store the value in the network under the given key, by looking up
+// the k nodes closest to the key and sending a STORE to each of them.
+// This node stores the value itself if it is among the k closest, and
+// in any case keeps the pair as its original publisher, republishing
+// it every tRepublish. Returns the number of nodes which accepted the
+// value, or an error if the key is not the size of an ID.
+func (d *Dht) PutKey(key []byte, value []byte) (int, error) {
+	writeLog("Putting key %v\n", key)
+	if err := checkKeySize(key); err != nil {
+		return 0, err
+	}
+
+	msg := d.formStoreKeyMsg(key, value)
+	msg.ExpirationTime = d.clock.Now().Add(publishedExpiration())
+
+	stored := d.storeOnClosest(d.LookupNode(key), msg)
+	d.Data.Publish(key, value, msg.ExpirationTime, msg.ReplicationInterval)
+	if stored == 0 {
+		return 0, fmt.Errorf("no nodes accepted store of key %v", key)
+	}
+
+	return stored, nil
+}
+
+// Time until a published pair expires, which must outlast the time
+// until the pair is republished, so the pair does not expire while
+// its publisher is still around. Republishing is due after tRepublish,
+// and is noticed by the background loop within tMaintenance.
+func publishedExpiration() time.Duration {
+	if tExpire > tRepublish+tMaintenance {
+		return tExpire
+	}
+
+	return tRepublish + tMaintenance
+}
+
+// Send the STORE message to each of the k nodes closest to its key
+// among the given contacts and this node, in parallel. Returns the
+// number of nodes which accepted the store.
+func (d *Dht) storeOnClosest(contacts []*Node, msg *Message) int {
+	nodes := append([]*Node{d.Node}, contacts...)
+	sortByDistance(nodes, msg.Key)
+	if len(nodes) > d.k {
+		nodes = nodes[:d.k]
+	}
+
+	return d.storeOnNodes(nodes, msg)
+}
+
+// Send the STORE message to each of the given nodes in parallel,
+// storing the pair directly if this node is among them. Returns
+// the number of nodes which accepted the store.
+func (d *Dht) storeOnNodes(nodes []*Node, msg *Message) int {
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	stored := 0
+	for _, node := range nodes {
+		if node.equals(d.Node) {
+			d.Data.Set(msg.Key, msg.Data, msg.ExpirationTime, msg.ReplicationInterval)
+			mtx.Lock()
+			stored++
+			mtx.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+
+			// Each node is sent its own copy of the request,
+			// so that responses are matched to the right node
+			req := *msg
+			req.MsgId = GenerateMsgId()
+			if _, err := d.call(&req, node, d.rpcTimeout); err != nil {
+				writeLog("Node %s did not accept store of key %v, error: %s\n", node.AddressString(), msg.Key, err)
+				return
+			}
+
+			mtx.Lock()
+			stored++
+			mtx.Unlock()
+		}(node)
+	}
+	wg.Wait()
+
+	return stored
+}
+
+// Replicate each pair in our store which has passed its replication
+// interval, by storing it on the k nodes currently closest to its key.
+// Replicas keep the expiration time of the pair, so replication alone
+// does not keep a pair alive, and pairs held only as a cached copy are
+// not replicated, so their shorter expiration does not spread.
+// Receiving a STORE for a pair restarts its replication timer, so pairs
+// recently stored by another node are not replicated again. Returns the
+// number of pairs replicated.
+func (d *Dht) replicateKeys() int {
+	replicated := 0
+	for _, key := range d.Data.GetKeysForReplicaion() {
+		value, err := d.Data.GetValue(key)
+		if err != nil || value.ExpirationTime.Before(d.clock.Now()) {
+			continue
+		}
+
+		writeLog("Replicating key %v\n", key)
+		msg := d.formStoreKeyMsg(key, value.Value)
+		msg.ExpirationTime = value.ExpirationTime
+		msg.ReplicationInterval = value.ReplicationInterval
+		d.storeOnClosest(d.LookupNode(key), msg)
+		d.Data.MarkReplicated(key)
+		replicated++
+	}
+
+	return replicated
+}
+
+// Start the background loop which replicates pairs in our store
+func (d *Dht) startReplication() {
+	d.runPeriodically(tMaintenance, func() { d.replicateKeys() })
+}
+
+// Republish each pair we originally published which was last published
+// at least tRepublish ago, storing it on the k nodes currently closest
+// to its key with a fresh expiration time. Returns the number of pairs
+// republished.
+func (d *Dht) republishKeys() int {
+	republished := 0
+	for _, key := range d.Data.GetKeysForRepublishing() {
+		value, err := d.Data.GetValue(key)
+		if err != nil {
+			continue
+		}
+
+		writeLog("Republishing key %v\n", key)
+		d.PutKey(key, value.Value)
+		republished++
+	}
+
+	return republished
+}
+
+// Start the background loop which republishes pairs we published
+func (d *Dht) startRepublish() {
+	d.runPeriodically(tMaintenance, func() { d.republishKeys() })
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// With fewer than k nodes in the network, a put should store the
+// value on every node, including the node which put the value
+func TestPutStoresOnClosestNodes(t *testing.T) {
+	dhts, _ := startSimDhts(8)
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	data := []byte("value stored across the network")
+	key, stored, err := dhts[len(dhts)-1].Put(data)
+	if err != nil {
+		t.Fatalf("Error putting value, error: %s", err)
+	}
+
+	if !bytes.Equal(key, Hash(data)) {
+		t.Errorf("Put should store value under key %v, got %v", Hash(data), key)
+	}
+
+	if stored != len(dhts) {
+		t.Errorf("Value should be stored on %d nodes, was stored on %d", len(dhts), stored)
+	}
+
+	for i, dht := range dhts {
+		if value, err := dht.Data.Get(key); err != nil || !bytes.Equal(value, data) {
+			t.Errorf("Node %d should hold value %s, got %s", i, data, value)
+		}
+	}
+}
+
+// A value put under a key by one node should be found by another
+func TestPutKeyThenLookupValue(t *testing.T) {
+	dhts, _ := startSimDhts(6)
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	key := Hash([]byte("application key"))
+	data := []byte("application value")
+	if _, err := dhts[len(dhts)-1].PutKey(key, data); err != nil {
+		t.Fatalf("Error putting key %v, error: %s", key, err)
+	}
+
+	if value, _, _ := dhts[0].LookupValue(key); !bytes.Equal(value, data) {
+		t.Errorf("Lookup for key %v should return %s, got %s", key, data, value)
+	}
+}
+
+// An empty value should be stored and found over the network, rather
+// than being taken for a missing value
+func TestPutKeyThenLookupEmptyValue(t *testing.T) {
+	dhts, _ := startSimDhts(2)
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	key := Hash([]byte("empty value"))
+	if _, err := dhts[1].PutKey(key, []byte{}); err != nil {
+		t.Fatalf("Error putting key %v, error: %s", key, err)
+	}
+
+	// Only the copy stored over the network is left to find
+	dhts[1].Data.Delete(key)
+
+	value, closest, err := dhts[1].LookupValue(key)
+	if err != nil || value == nil || len(value) != 0 || closest != nil {
+		t.Errorf("Lookup for key %v should return the empty value, got %v, closest %v, error %v", key, value, closest, err)
+	}
+}
+
+// Pairs past their replication interval should be stored on the
+// closest nodes, keeping their expiration time
+func TestReplicateKeys(t *testing.T) {
+	clock := newFakeClock()
+	dhts, _ := startSimDhts(4, WithClock(clock))
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	holder := dhts[len(dhts)-1]
+	holder.LookupNode(holder.Node.Id)
+
+	data := []byte("replicated value")
+	key := Hash(data)
+	expiration := clock.Now().Add(tExpire)
+	holder.Data.Set(key, data, expiration, tReplicate)
+
+	if replicated := holder.replicateKeys(); replicated != 0 {
+		t.Errorf("Pair within replication interval should not be replicated, got %d", replicated)
+	}
+
+	clock.Advance(2 * tReplicate)
+
+	if replicated := holder.replicateKeys(); replicated != 1 {
+		t.Fatalf("Expected 1 pair to be replicated, got %d", replicated)
+	}
+
+	for i, dht := range dhts {
+		value, err := dht.Data.GetValue(key)
+		if err != nil || !bytes.Equal(value.Value, data) {
+			t.Errorf("Node %d should hold replicated value %s, got %v", i, data, value)
+			continue
+		}
+
+		if !value.ExpirationTime.Equal(expiration) {
+			t.Errorf("Node %d should keep expiration time %s, got %s", i, expiration, value.ExpirationTime)
+		}
+	}
+
+	if replicated := holder.replicateKeys(); replicated != 0 {
+		t.Errorf("Pair which was just replicated should not be replicated, got %d", replicated)
+	}
+}
+
+// A node holding a pair only as a cached copy should not replicate
+// it, leaving the expiration held by the k closest nodes unchanged
+func TestReplicateKeysSkipsCachedCopies(t *testing.T) {
+	clock := newFakeClock()
+	dhts, _ := startSimDhts(6, WithBucketSize(2), WithClock(clock))
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+	for _, dht := range dhts {
+		dht.LookupNode(dht.Node.Id)
+	}
+
+	data := []byte("cached value")
+	key, _, err := dhts[0].Put(data)
+	if err != nil {
+		t.Fatalf("Error putting value, error: %s", err)
+	}
+
+	expirations := make(map[*Dht]time.Time)
+	var far *Dht
+	for _, dht := range dhts[1:] {
+		if value, err := dht.Data.GetValue(key); err == nil {
+			expirations[dht] = value.ExpirationTime
+		} else {
+			far = dht
+		}
+	}
+	if far == nil {
+		t.Fatalf("Expected a node beyond the k closest to the key")
+	}
+
+	req := dhts[0].formStoreKeyMsg(key, data)
+	req.Cached = true
+	if _, err := far.Store(req); err != nil {
+		t.Fatalf("Error caching value, error: %s", err)
+	}
+
+	// The cached copy is due for replication once tReplicate passes,
+	// and lives for at least tExpire/16, with at most 5 nodes closer
+	clock.Advance(tReplicate + tMaintenance)
+	if value, err := far.Data.GetValue(key); err != nil || value.ExpirationTime.Before(clock.Now()) {
+		t.Fatalf("Cached copy should not expire before it is due for replication, got %v", value)
+	}
+
+	if replicated := far.replicateKeys(); replicated != 0 {
+		t.Errorf("Cached copy should not be replicated, got %d", replicated)
+	}
+
+	for dht, expiration := range expirations {
+		if value, err := dht.Data.GetValue(key); err != nil || !value.ExpirationTime.Equal(expiration) {
+			t.Errorf("Node %v should keep expiration time %s, got %v", dht.Node.Id, expiration, value)
+		}
+	}
+}
+
+// Keys which are not the size of an ID should be refused, as they
+// cannot be placed in the range of a bucket
+func TestPutKeyRejectsShortKey(t *testing.T) {
+	dhts, _ := startSimDhts(2)
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	for _, key := range [][]byte{nil, dhts[0].Node.Id[:1], dhts[0].Node.Id[:keysize-1]} {
+		if _, err := dhts[1].PutKey(key, []byte("value")); err == nil {
+			t.Errorf("Put of key of %d bytes should fail", len(key))
+		}
+
+		if _, _, err := dhts[1].LookupValue(key); err == nil {
+			t.Errorf("Lookup of key of %d bytes should fail", len(key))
+		}
+	}
+
+	if count := len(dhts[0].Data.Keys()); count != 0 {
+		t.Errorf("No pair should be stored for short keys, got %d", count)
+	}
+}
+
+// The original publisher should republish its pairs, extending
+// the expiration time of the copies held by other nodes
+func TestRepublishKeys(t *testing.T) {
+	clock := newFakeClock()
+	dhts, _ := startSimDhts(4, WithClock(clock))
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	publisher := dhts[len(dhts)-1]
+	key, _, err := publisher.Put([]byte("republished value"))
+	if err != nil {
+		t.Fatalf("Error putting value, error: %s", err)
+	}
+
+	if republished := publisher.republishKeys(); republished != 0 {
+		t.Errorf("Freshly published pair should not be republished, got %d", republished)
+	}
+
+	// Let a day pass, so that the pair approaches expiry everywhere
+	clock.Advance(tRepublish)
+
+	if republished := publisher.republishKeys(); republished != 1 {
+		t.Fatalf("Expected 1 pair to be republished, got %d", republished)
+	}
+
+	for i, dht := range dhts {
+		value, err := dht.Data.GetValue(key)
+		if err != nil || !value.ExpirationTime.After(clock.Now().Add(tExpire/2)) {
+			t.Errorf("Node %d should hold pair with extended expiration time, got %v", i, value)
+		}
+
+		if value != nil && value.OriginalPublisher != (dht == publisher) {
+			t.Errorf("Only the publisher should be the original publisher of the pair")
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Encrypt every connection with TLS, authenticating each end with a
+// self-signed certificate for the key pair of its node. The transport
+// given with WithTransport is wrapped, and must carry a stream of
+// bytes in both directions, as TCP does.
+func WithTLS() DhtOption {
+	return func(d *Dht) {
+		d.encrypted = true
+	}
+}
+
+// Connection whose peer proved ownership of a public key, and with it
+// the node ID derived from the key
+type authenticatedConn interface {
+	net.Conn
+	PeerKey() (ed25519.PublicKey, error)
+}
+
+// Transport encrypting each connection of an underlying transport with
+// TLS 1.3. Both ends present a self-signed certificate for the Ed25519
+// key pair of their node, rather than one signed by an authority, and
+// prove that they hold its private key in the handshake. The key of
+// the peer then binds the connection to the node ID derived from it.
+type TLSTransport struct {
+	transport Transport
+	config    *tls.Config
+}
+
+func NewTLSTransport(transport Transport, privateKey ed25519.PrivateKey) (*TLSTransport, error) {
+	cert, err := selfSignedCertificate(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSTransport{
+		transport: transport,
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+			// Peers are not known by name, so the chain of their
+			// certificate is checked by verifyPeerCertificate rather
+			// than against authorities
+			InsecureSkipVerify:    true,
+			ClientAuth:            tls.RequireAnyClientCert,
+			VerifyPeerCertificate: verifyPeerCertificate,
+			// The dialing end writes a single message and closes the
+			// connection without reading, so is sent nothing after
+			// the handshake
+			SessionTicketsDisabled: true,
+		},
+	}, nil
+}
+
+func (t *TLSTransport) Listen(port int) (net.Listener, error) {
+	listener, err := t.transport.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsListener{Listener: listener, config: t.config}, nil
+}
+
+func (t *TLSTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.transport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	secure := tls.Client(conn, t.config)
+	secure.SetDeadline(time.Now().Add(tRpcTimeout))
+	if err := secure.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	secure.SetDeadline(time.Time{})
+
+	return &tlsConn{secure}, nil
+}
+
+// Listener accepting connections of the underlying transport, whose
+// handshake is made on their first read
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsConn{tls.Server(conn, l.config)}, nil
+}
+
+type tlsConn struct {
+	*tls.Conn
+}
+
+// Get the key the peer proved ownership of, completing the handshake
+// if it has not yet been made
+func (c *tlsConn) PeerKey() (ed25519.PublicKey, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("peer presented no certificate")
+	}
+
+	key, ok := certs[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("peer certificate is not for an Ed25519 key")
+	}
+
+	return key, nil
+}
+
+// Create a self-signed certificate for the key pair of a node
+func selfSignedCertificate(privateKey ed25519.PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(100 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("creating node certificate: %s", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privateKey}, nil
+}
+
+// Check that the peer presented a single certificate, for an Ed25519
+// key, and signed with that key
+func verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) != 1 {
+		return fmt.Errorf("expected a single peer certificate, got %d", len(rawCerts))
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	if _, ok := cert.PublicKey.(ed25519.PublicKey); !ok {
+		return errors.New("peer certificate is not for an Ed25519 key")
+	}
+
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TCP transport recording every byte written to the connections it
+// dials, as seen by anyone watching the network
+type recordingTransport struct {
+	TCPTransport
+	mtx     sync.Mutex
+	written bytes.Buffer
+}
+
+func (t *recordingTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.TCPTransport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordingConn{Conn: conn, transport: t}, nil
+}
+
+func (t *recordingTransport) contains(data []byte) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return bytes.Contains(t.written.Bytes(), data)
+}
+
+type recordingConn struct {
+	net.Conn
+	transport *recordingTransport
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.transport.mtx.Lock()
+	c.transport.written.Write(b)
+	c.transport.mtx.Unlock()
+	return c.Conn.Write(b)
+}
+
+// Nodes using TLS should be able to call one another, look up nodes
+// and store values, without the values crossing the network in the
+// clear
+func TestTLSTransport(t *testing.T) {
+	wire := &recordingTransport{}
+	dhts := startDhts(4, WithTransport(wire), WithTLS())
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	if err := dhts[1].pingNode(dhts[0].Node); err != nil {
+		t.Fatalf("Error pinging over TLS, error: %s", err)
+	}
+
+	last := dhts[len(dhts)-1]
+	if result := last.LookupNode(dhts[0].Node.Id); len(result) == 0 || !result[0].equals(dhts[0].Node) {
+		t.Fatalf("Lookup over TLS should find node %v", dhts[0].Node.Id)
+	}
+
+	data := []byte("value which must not be sent in the clear")
+	key, stored, err := last.Put(data)
+	if err != nil || stored != len(dhts) {
+		t.Fatalf("Value should be stored on %d nodes over TLS, stored on %d, error: %v", len(dhts), stored, err)
+	}
+
+	if value, _, _ := dhts[0].LookupValue(key); !bytes.Equal(value, data) {
+		t.Errorf("Lookup over TLS should return %s, got %s", data, value)
+	}
+
+	if wire.contains(data) {
+		t.Errorf("Value should be encrypted on the network")
+	}
+}
+
+// Nodes which do not use TLS should not be able to talk to nodes which
+// do, in either direction
+func TestTLSRejectsPlaintextPeers(t *testing.T) {
+	plain := serveDht(NewDht(WithRPCTimeout(50 * time.Millisecond)))
+	secure := serveDht(NewDht(WithRPCTimeout(50*time.Millisecond), WithTLS()))
+	defer stopDhts([]*Dht{plain, secure})
+
+	if err := plain.pingNode(secure.Node); err == nil {
+		t.Errorf("Ping in the clear should not be answered by node using TLS")
+	}
+
+	if err := secure.pingNode(plain.Node); err == nil {
+		t.Errorf("Ping over TLS should not be answered by node not using TLS")
+	}
+
+	if knowsNode(plain, secure.Node) || knowsNode(secure, plain.Node) {
+		t.Errorf("Nodes should not place peers they cannot talk to in k-buckets")
+	}
+}
+
+// Messages should only be accepted from the node whose key the
+// connection was authenticated with, and only sent to the node whose
+// ID is derived from the key of the peer
+func TestTLSBindsPeerKeyToNodeId(t *testing.T) {
+	d := serveDht(NewDht(WithRPCTimeout(50*time.Millisecond), WithTLS()))
+	defer stopDhts([]*Dht{d})
+
+	// The impostor signs messages with its own key, but authenticates
+	// its connections with another key
+	_, otherKey := NewIdentity()
+	transport, err := NewTLSTransport(TCPTransport{}, otherKey)
+	if err != nil {
+		t.Fatalf("Error creating TLS transport, error: %s", err)
+	}
+	impostor := serveDht(NewDht(WithRPCTimeout(50*time.Millisecond), WithTransport(transport)))
+	defer stopDhts([]*Dht{impostor})
+
+	if err := impostor.pingNode(d.Node); err == nil {
+		t.Errorf("Ping over connection authenticated with another key should not be answered")
+	}
+
+	if knowsNode(d, impostor.Node) {
+		t.Errorf("Node sending over connection authenticated with another key should not be placed in k-buckets")
+	}
+
+	// Another node listening at the address of a node should not be
+	// sent messages for that node
+	elsewhere := *d.Node
+	elsewhere.Id = NewNode().Id
+	if err := d.sendMessageToNode(d.formPingMsg(false), &elsewhere); err == nil {
+		t.Errorf("Message should not be sent to peer which does not own the node ID")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Transport carries messages between nodes. The dht listens for
+// incoming connections through the transport, and dials a new
+// connection through the transport for each message it sends. Each
+// connection carries the encoding of a single message.
+type Transport interface {
+	// Listen for incoming connections on the given port
+	Listen(port int) (net.Listener, error)
+	// Dial a connection to the node at the given address
+	Dial(addr string) (net.Conn, error)
+}
+
+// Use the given transport to send and receive messages, rather
+// than the default TCP transport
+func WithTransport(transport Transport) DhtOption {
+	return func(d *Dht) {
+		d.Transport = transport
+	}
+}
+
+// Get the transport with the given name, as selected on the command line
+func transportByName(name string) (Transport, error) {
+	switch name {
+	case "tcp":
+		return TCPTransport{}, nil
+	case "udp":
+		return UDPTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %s", name)
+	}
+}
+
+// Transport sending each message over its own TCP connection
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(port int) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
+func (TCPTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, tRpcTimeout)
+}
+
+// Transport sending each message as a single UDP datagram, as in the
+// original Kademlia specification. Datagrams are not retransmitted, so
+// lost messages surface as requests timing out.
+type UDPTransport struct{}
+
+// Maximum payload of a single UDP datagram
+const maxDatagramSize = 65507
+
+func (UDPTransport) Listen(port int) (net.Listener, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	return &datagramListener{conn: conn}, nil
+}
+
+func (UDPTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("udp", addr, tRpcTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &datagramConn{Conn: conn}, nil
+}
+
+// Listener which accepts each datagram received on a UDP socket as
+// a connection, which reads the datagram and then reaches EOF
+type datagramListener struct {
+	conn *net.UDPConn
+}
+
+func (l *datagramListener) Accept() (net.Conn, error) {
+	buf := make([]byte, maxDatagramSize)
+	n, addr, err := l.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &receivedDatagram{
+		Reader: bytes.NewReader(buf[:n]),
+		local:  l.conn.LocalAddr(),
+		remote: addr,
+	}, nil
+}
+
+func (l *datagramListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *datagramListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Connection over a received datagram, which can only be read
+type receivedDatagram struct {
+	*bytes.Reader
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *receivedDatagram) Write(b []byte) (int, error) {
+	return 0, errors.New("cannot write to a received datagram")
+}
+
+func (c *receivedDatagram) Close() error                       { return nil }
+func (c *receivedDatagram) LocalAddr() net.Addr                { return c.local }
+func (c *receivedDatagram) RemoteAddr() net.Addr               { return c.remote }
+func (c *receivedDatagram) SetDeadline(t time.Time) error      { return nil }
+func (c *receivedDatagram) SetReadDeadline(t time.Time) error  { return nil }
+func (c *receivedDatagram) SetWriteDeadline(t time.Time) error { return nil }
+
+// Connection over a dialed UDP socket, which buffers everything
+// written to it, and sends it as a single datagram on closing
+type datagramConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	if c.buf.Len()+len(b) > maxDatagramSize {
+		return 0, fmt.Errorf("message exceeds maximum datagram size of %d bytes", maxDatagramSize)
+	}
+
+	return c.buf.Write(b)
+}
+
+func (c *datagramConn) Close() error {
+	defer c.Conn.Close()
+	if c.buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := c.Conn.Write(c.buf.Bytes())
+	return err
+}
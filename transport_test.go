@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Nodes using the UDP transport should be able to call one another,
+// look up nodes and store values
+func TestUDPTransport(t *testing.T) {
+	dhts := startDhts(6, WithTransport(UDPTransport{}))
+	defer stopDhts(dhts)
+	chainDhts(dhts)
+
+	if err := dhts[1].pingNode(dhts[0].Node); err != nil {
+		t.Fatalf("Error pinging over UDP, error: %s", err)
+	}
+
+	last := dhts[len(dhts)-1]
+	if result := last.LookupNode(dhts[0].Node.Id); len(result) == 0 || !result[0].equals(dhts[0].Node) {
+		t.Fatalf("Lookup over UDP should find node %v", dhts[0].Node.Id)
+	}
+
+	data := []byte("value sent over udp")
+	key, stored, err := last.Put(data)
+	if err != nil || stored != len(dhts) {
+		t.Fatalf("Value should be stored on %d nodes over UDP, stored on %d, error: %v", len(dhts), stored, err)
+	}
+
+	if value, _, _ := dhts[0].LookupValue(key); !bytes.Equal(value, data) {
+		t.Errorf("Lookup over UDP should return %s, got %s", data, value)
+	}
+}
+
+// Messages which do not fit in a single datagram should fail to send
+func TestUDPTransportRejectsOversizedMessage(t *testing.T) {
+	dhts := startDhts(2, WithTransport(UDPTransport{}))
+	defer stopDhts(dhts)
+
+	msg := dhts[1].formStoreKeyMsg(Hash([]byte("key")), make([]byte, maxDatagramSize))
+	if err := dhts[1].sendMessage(msg, dhts[0].Node.AddressString()); err == nil {
+		t.Errorf("Sending message larger than a datagram should fail")
+	}
+}
+
+func TestTransportByName(t *testing.T) {
+	if transport, err := transportByName("tcp"); err != nil || transport != (TCPTransport{}) {
+		t.Errorf("Expected TCP transport, got %v, error: %v", transport, err)
+	}
+
+	if transport, err := transportByName("udp"); err != nil || transport != (UDPTransport{}) {
+		t.Errorf("Expected UDP transport, got %v, error: %v", transport, err)
+	}
+
+	if _, err := transportByName("carrier pigeon"); err == nil {
+		t.Errorf("Expected error for unknown transport")
+	}
+}
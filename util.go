@@ -1,9 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/sha1"
 	"log"
-	"math/rand"
 	"time"
 )
 
@@ -25,6 +25,15 @@ const (
 	tRefresh         = time.Duration(time.Hour)                    // time after which bucket is refreshed
 	tReplicate       = time.Duration(time.Hour)                    // time after which key value pair is replicated
 	tRepublish       = time.Duration(24*time.Hour + 1*time.Minute) // time after which original publisher re-publishes key
+	tRpcTimeout      = time.Duration(2 * time.Second)              // time to wait for a node to respond to a request
+	tLeave           = time.Duration(30 * time.Second)             // time allowed for handing off keys when leaving the network
+	tMaintenance     = time.Duration(time.Minute)                  // time between checks for background maintenance work
+)
+
+const (
+	maxListenAttempts       = 10  // the number of ports tried before giving up on listening
+	connClosedBacklog       = 128 // the number of connection closed signals buffered for waiters
+	maxReplacementsInBucket = 20  // the maximum replacement candidates kept for a single bucket
 )
 
 // gets sha checksum for a data byte slice, resuts is a 160-bit key
@@ -33,7 +42,7 @@ func Hash(data []byte) []byte {
 	return hash[:]
 }
 
-// generate 64-bit random message ID
+// generate 128-bit random message ID, which other nodes cannot predict
 func GenerateMsgId() []byte {
 	msgId := make([]byte, 16)
 	_, err := rand.Read(msgId)